@@ -6,12 +6,15 @@ export GOFLAGS="${GOFLAGS} -mod=vendor"
 
 [ ! -d ${PWD}/bin ] && mkdir -p "${PWD}/bin"
 
-echo "Building..."
+# glued与glue插件使用同一个版本，写入子网文件用于检查版本是否一致
+GLUE_VERSION=${GLUE_VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo v0.1)}
+
+echo "Building $GLUE_VERSION..."
 APPS="cni-plugins/* glued"
 for d in $APPS; do
 	if [ -d "$d" ]; then
 		app="$(basename "$d")"
 		echo "Build $app"
-		${GO:-go} build -o "${PWD}/bin/$app" "$@" ./"$d"
+		${GO:-go} build -ldflags "-X main.glueVersion=${GLUE_VERSION}" -o "${PWD}/bin/$app" "$@" ./"$d"
 	fi
 done
@@ -9,11 +9,13 @@ import (
 	"os"
 	"syscall"
 	"path/filepath"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
@@ -39,9 +41,16 @@ NetConf 文件格式
 }
 */
 
+// 构建时通过 -ldflags "-X main.glueVersion=..." 指定，与glued使用同一个版本
+var glueVersion = "v0.1"
+
 const (
 	defaultSubnetFile = "/run/glue/subnet.json"
 	defaultDataDir    = "/var/lib/cni/glue"
+	defaultPodsDir    = "/run/glue/pods"
+	defaultIPAMDir    = "/var/lib/cni/networks"
+	namedNetnsDir     = "/var/run/netns"
+	glueRunDir        = "/run/glue"
 )
 
 type NetConf struct {
@@ -51,6 +60,26 @@ type NetConf struct {
 	Delegate   map[string]interface{} `json:"delegate"`
 	SubnetFile    string              `json:"subnetFile"`
 	DataDir       string              `json:"dataDir"`
+	PodsDir       string              `json:"podsDir"`
+	NodeNetns     string              `json:"nodeNetns,omitempty"` // glued -netns 指定的命名空间
+}
+
+// kubelet 通过 CNI_ARGS 传入的 pod 信息
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAME      types.UnmarshallableString
+	K8S_POD_NAMESPACE types.UnmarshallableString
+}
+
+// 节点上pod的记录，供glued根据pod找到其网络命名空间
+type PodRecord struct {
+	ContainerID  string   `json:"containerID"`
+	PodName      string   `json:"podName"`
+	PodNamespace string   `json:"podNamespace"`
+	Netns        string   `json:"netns"`
+	IfName       string   `json:"ifName"`
+	IPs          []string `json:"ips"`
+	Gateway      string   `json:"gateway,omitempty"`
 }
 
 // Glue 子网参数配置，由glue容器动态生成
@@ -64,6 +93,7 @@ type GlueSubnetConf struct {
 		Mode   string `yaml:"mode"`
 	}
 	DefaultNeighMac string `yaml:"defaultNeighMac,omitempty"`
+	Version         string `json:"version,omitempty"`
 }
 
 func hasKey(m map[string]interface{}, k string) bool {
@@ -81,6 +111,7 @@ func loadNetConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{
 		SubnetFile: defaultSubnetFile,
 		DataDir:    defaultDataDir,
+		PodsDir:    defaultPodsDir,
 	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
@@ -90,10 +121,45 @@ func loadNetConf(bytes []byte) (*NetConf, error) {
 		n.Delegate = make(map[string]interface{})
 	}
 
+	// 节点运行在网络命名空间中时，默认路径与glued保持一致按命名空间区分
+	if n.NodeNetns != "" {
+		name := filepath.Base(n.NodeNetns)
+		if n.SubnetFile == defaultSubnetFile {
+			n.SubnetFile = filepath.Join(glueRunDir, name, filepath.Base(defaultSubnetFile))
+		}
+		if n.DataDir == defaultDataDir {
+			n.DataDir = filepath.Join(defaultDataDir, name)
+		}
+		if n.PodsDir == defaultPodsDir {
+			n.PodsDir = filepath.Join(glueRunDir, name, filepath.Base(defaultPodsDir))
+		}
+	}
+
 	n.Delegate["cniVersion"] = n.CNIVersion
 	return n, nil
 }
 
+// 在节点的网络命名空间中执行，master网卡和conntrack表都在其中
+func inNodeNetns(n *NetConf, f func() error) error {
+	if n.NodeNetns == "" {
+		return f()
+	}
+
+	path := n.NodeNetns
+	if !strings.Contains(path, "/") {
+		path = filepath.Join(namedNetnsDir, path)
+	}
+	netns, err := ns.GetNS(path)
+	if err != nil {
+		return fmt.Errorf("failed to open node netns %q: %v", n.NodeNetns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return f()
+	})
+}
+
 func loadGlueSubnet(path string) (*GlueSubnetConf, error) {
 	netConfBytes, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -234,10 +300,15 @@ func genDelegateInfo(n *NetConf, subnet *GlueSubnetConf) (map[string]string, err
 
 	ipam["ranges"] = rangesSlice
 
+	// 多个节点命名空间共用主机文件系统，地址分配记录分开保存
+	if n.NodeNetns != "" {
+		ipam["dataDir"] = filepath.Join(defaultIPAMDir, filepath.Base(n.NodeNetns))
+	}
+
 	rtes := []types.Route{}
 	
 	// 默认路由不指定网关地址，使用CNI配置文件中的网关
-	rtes = append(rtes, types.Route{ Dst: net.IPNet { net.IPv4(0,0,0,0), net.CIDRMask(0,32)}})
+	rtes = append(rtes, types.Route{ Dst: net.IPNet { IP: net.IPv4(0,0,0,0), Mask: net.CIDRMask(0,32)}})
 
 	// 仅ipvlan场景需要增加服务网关
 	if subnet.Master.Type == "ipvlan" {
@@ -328,6 +399,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// 插件与glued版本不一致时只告警，子网文件格式保持兼容
+	if subnet.Version != "" && subnet.Version != glueVersion {
+		fmt.Fprintf(os.Stderr, "glue: version skew, plugin %s, glued %s\n", glueVersion, subnet.Version)
+	}
+
 	neighs, err := genDelegateInfo(n, subnet)
 	if err != nil {
 		return fmt.Errorf("failed to generate delegate info: %w", err)
@@ -342,7 +418,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result, err := invoke.DelegateAdd(context.TODO(), n.Delegate["type"].(string), buf, nil)
+	var result types.Result
+	err = inNodeNetns(n, func() error {
+		var err error
+		result, err = invoke.DelegateAdd(context.TODO(), n.Delegate["type"].(string), buf, nil)
+		return err
+	})
 	if err != nil {
 		_ = os.Remove(path)
 		return err
@@ -350,9 +431,104 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// 更新neigh参数
 	updateNeigh(neighs, args)
+
+	if err := savePodRecord(args, n.PodsDir, result); err != nil {
+		fmt.Fprintf(os.Stderr, "glue: save pod record fail - %v\n", err)
+	}
 	return types.PrintResult(result, n.CNIVersion)
 }
 
+// 记录pod信息，失败不影响pod创建
+func savePodRecord(args *skel.CmdArgs, podsDir string, result types.Result) error {
+	k8sArgs := K8sArgs{}
+	if err := types.LoadArgs(args.Args, &k8sArgs); err != nil {
+		return fmt.Errorf("failed to parse CNI_ARGS: %v", err)
+	}
+
+	rec := PodRecord{
+		ContainerID:  args.ContainerID,
+		PodName:      string(k8sArgs.K8S_POD_NAME),
+		PodNamespace: string(k8sArgs.K8S_POD_NAMESPACE),
+		Netns:        args.Netns,
+		IfName:       args.IfName,
+	}
+
+	if res, err := current.NewResultFromResult(result); err == nil {
+		for _, ipc := range res.IPs {
+			rec.IPs = append(rec.IPs, ipc.Address.IP.String())
+			// glued根据网关判断glue设备的旧地址是否仍在使用
+			if rec.Gateway == "" && ipc.Gateway != nil {
+				rec.Gateway = ipc.Gateway.String()
+			}
+		}
+	}
+
+	if err := os.MkdirAll(podsDir, 0700); err != nil {
+		return err
+	}
+	buf, _ := json.Marshal(rec)
+	return ioutil.WriteFile(filepath.Join(podsDir, args.ContainerID), buf, 0600)
+}
+
+func loadPodRecordIPs(podsDir, containerID string) []net.IP {
+	buf, err := ioutil.ReadFile(filepath.Join(podsDir, containerID))
+	if err != nil {
+		return nil
+	}
+	rec := PodRecord{}
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, s := range rec.IPs {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// 原始方向或应答方向中包含指定地址的conntrack表项
+type conntrackIPFilter struct {
+	ips []net.IP
+}
+
+func (f *conntrackIPFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, ip := range f.ips {
+		if ip.Equal(flow.Forward.SrcIP) || ip.Equal(flow.Forward.DstIP) ||
+			ip.Equal(flow.Reverse.SrcIP) || ip.Equal(flow.Reverse.DstIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 删除pod地址相关的conntrack表项，避免地址复用后旧的UDP会话继续发往原来的对端
+func flushPodConntrack(ips []net.IP) {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	families := []struct {
+		family netlink.InetFamily
+		ips    []net.IP
+	}{{netlink.FAMILY_V4, v4}, {netlink.FAMILY_V6, v6}}
+	for _, f := range families {
+		if len(f.ips) == 0 {
+			continue
+		}
+		if _, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, f.family, &conntrackIPFilter{ips: f.ips}); err != nil {
+			fmt.Fprintf(os.Stderr, "glue: flush conntrack for %v fail: %v\n", f.ips, err)
+		}
+	}
+}
+
 func consumeContNetConf(containerID, dataDir string) (func(error), []byte, error) {
 	path := filepath.Join(dataDir, containerID)
 	cleanup := func(err error) {
@@ -372,10 +548,15 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// pod记录仅供glued使用，与网络配置一样在删除成功后移除，DEL重试时仍能读取地址
+	podIPs := loadPodRecordIPs(n.PodsDir, args.ContainerID)
+	podRecord := filepath.Join(n.PodsDir, args.ContainerID)
+
 	cleanup, netConfBytes, err := consumeContNetConf(args.ContainerID, n.DataDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Per spec should ignore error if resources are missing / already removed
+			_ = os.Remove(podRecord)
 			return nil
 		}
 		return err
@@ -391,10 +572,21 @@ func cmdDel(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to parse netconf: %v", err)
 	}
 
-	return invoke.DelegateDel(context.TODO(), ncToDel.Type, netConfBytes, nil)
+	err = inNodeNetns(n, func() error {
+		if err := invoke.DelegateDel(context.TODO(), ncToDel.Type, netConfBytes, nil); err != nil {
+			return err
+		}
+		flushPodConntrack(podIPs)
+		return nil
+	})
+	if err == nil {
+		_ = os.Remove(podRecord)
+	}
+	return err
 }
 
 func main() {
+	bv.BuildVersion = glueVersion
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("glue"))
 }
 
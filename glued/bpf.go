@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+将抓包过滤表达式编译为BPF指令，支持tcpdump语法的常用子集，不依赖tcpdump：
+
+	协议：ip、ip6、arp、tcp、udp、icmp
+	地址：[src|dst] host 10.0.0.1、[src|dst] net 10.0.0.0/24，省略host时按host处理
+	端口：[tcp|udp] [src|dst] port 80
+	组合：and(&&)、or(||)、not(!)、括号
+
+链路层为以太网，匹配结果与tcpdump一致：
+
+	地址匹配IPv4及ARP/RARP报文中的IPv4地址
+	tcp/udp同时匹配IPv6，IPv6只识别分片扩展头；icmp只匹配IPv4
+	端口同时匹配IPv6，未指定协议时匹配tcp/udp/sctp，不匹配IPv4分片的后续报文
+*/
+
+const (
+	bpfEtherIP   = 0x0800
+	bpfEtherARP  = 0x0806
+	bpfEtherRARP = 0x8035
+	bpfEtherIPv6 = 0x86dd
+
+	bpfOffEtherType  = 12
+	bpfOffIPProto    = 14 + 9
+	bpfOffIPFrag     = 14 + 6
+	bpfOffIPSrc      = 14 + 12
+	bpfOffIPDst      = 14 + 16
+	bpfOffIPHdr      = 14
+	bpfOffArpSrc     = 14 + 14
+	bpfOffArpDst     = 14 + 24
+	bpfOffIP6Next    = 14 + 6
+	bpfOffIP6Payload = 14 + 40
+)
+
+var bpfIPProtos = map[string]uint32{"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP, "icmp": unix.IPPROTO_ICMP}
+
+// 过滤条件，叶子节点加载数据后比较
+type bpfNode struct {
+	op    string // and/or/not/test
+	left  *bpfNode
+	right *bpfNode
+
+	loads []unix.SockFilter
+	jump  uint16 // BPF_JEQ/BPF_JSET
+	k     uint32
+}
+
+func bpfAnd(nodes ...*bpfNode) *bpfNode {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = &bpfNode{op: "and", left: n, right: m}
+	}
+	return n
+}
+
+func bpfOr(nodes ...*bpfNode) *bpfNode {
+	n := nodes[0]
+	for _, m := range nodes[1:] {
+		n = &bpfNode{op: "or", left: n, right: m}
+	}
+	return n
+}
+
+func bpfNot(a *bpfNode) *bpfNode {
+	return &bpfNode{op: "not", left: a}
+}
+
+func bpfTest(jump uint16, k uint32, loads ...unix.SockFilter) *bpfNode {
+	return &bpfNode{op: "test", loads: loads, jump: jump, k: k}
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfEtherType(t uint32) *bpfNode {
+	return bpfTest(unix.BPF_JEQ, t, bpfStmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, bpfOffEtherType))
+}
+
+func bpfByteEq(off, k uint32) *bpfNode {
+	return bpfTest(unix.BPF_JEQ, k, bpfStmt(unix.BPF_LD|unix.BPF_B|unix.BPF_ABS, off))
+}
+
+func bpfIPProto(p uint32) *bpfNode {
+	return bpfAnd(bpfEtherType(bpfEtherIP), bpfByteEq(bpfOffIPProto, p))
+}
+
+// IPv6下一个头为该协议，或为分片扩展头且其后为该协议
+func bpfIP6Proto(p uint32) *bpfNode {
+	return bpfAnd(bpfEtherType(bpfEtherIPv6),
+		bpfOr(bpfByteEq(bpfOffIP6Next, p),
+			bpfAnd(bpfByteEq(bpfOffIP6Next, unix.IPPROTO_FRAGMENT), bpfByteEq(bpfOffIP6Payload, p))))
+}
+
+// 按方向选择源/目的条件，未指定方向时任一满足即可
+func bpfDir(dir string, src, dst *bpfNode) *bpfNode {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return bpfOr(src, dst)
+}
+
+func bpfIPNet(dir string, ipnet *net.IPNet) *bpfNode {
+	addr := Ipv4ToUint32(ipnet.IP.To4())
+	mask := Ipv4ToUint32(net.IP(ipnet.Mask).To4())
+	test := func(off uint32) *bpfNode {
+		loads := []unix.SockFilter{bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, off)}
+		if mask != 0xffffffff {
+			loads = append(loads, bpfStmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, mask))
+		}
+		return bpfTest(unix.BPF_JEQ, addr&mask, loads...)
+	}
+
+	return bpfOr(
+		bpfAnd(bpfEtherType(bpfEtherIP), bpfDir(dir, test(bpfOffIPSrc), test(bpfOffIPDst))),
+		bpfAnd(bpfOr(bpfEtherType(bpfEtherARP), bpfEtherType(bpfEtherRARP)), bpfDir(dir, test(bpfOffArpSrc), test(bpfOffArpDst))))
+}
+
+// IPv4端口位于IP头之后，X寄存器加载IP头长度；IPv6端口位于固定头之后
+func bpfPort(proto, dir string, port uint32) *bpfNode {
+	protos := []uint32{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP}
+	if proto != "" {
+		protos = []uint32{bpfIPProtos[proto]}
+	}
+	var ipProto, ip6Proto []*bpfNode
+	for _, p := range protos {
+		ipProto = append(ipProto, bpfByteEq(bpfOffIPProto, p))
+		ip6Proto = append(ip6Proto, bpfByteEq(bpfOffIP6Next, p))
+	}
+
+	ipTest := func(off uint32) *bpfNode {
+		return bpfTest(unix.BPF_JEQ, port,
+			bpfStmt(unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH, bpfOffIPHdr),
+			bpfStmt(unix.BPF_LD|unix.BPF_H|unix.BPF_IND, bpfOffIPHdr+off))
+	}
+	ip6Test := func(off uint32) *bpfNode {
+		return bpfTest(unix.BPF_JEQ, port, bpfStmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, bpfOffIP6Payload+off))
+	}
+	notFrag := bpfNot(bpfTest(unix.BPF_JSET, 0x1fff, bpfStmt(unix.BPF_LD|unix.BPF_H|unix.BPF_ABS, bpfOffIPFrag)))
+
+	return bpfOr(
+		bpfAnd(bpfEtherType(bpfEtherIP), bpfOr(ipProto...), notFrag, bpfDir(dir, ipTest(0), ipTest(2))),
+		bpfAnd(bpfEtherType(bpfEtherIPv6), bpfOr(ip6Proto...), bpfDir(dir, ip6Test(0), ip6Test(2))))
+}
+
+type bpfParser struct {
+	tokens []string
+	pos    int
+}
+
+func tokenizeFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+func (p *bpfParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *bpfParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *bpfParser) parseOr() (*bpfNode, error) {
+	n, err := p.parseAnd()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var m *bpfNode
+		if m, err = p.parseAnd(); err == nil {
+			n = bpfOr(n, m)
+		}
+	}
+	return n, err
+}
+
+// 相邻的条件没有连接词时按and处理
+func (p *bpfParser) parseAnd() (*bpfNode, error) {
+	n, err := p.parseUnary()
+	for err == nil {
+		t := p.peek()
+		if t == "" || t == "or" || t == ")" {
+			break
+		}
+		if t == "and" {
+			p.next()
+		}
+		var m *bpfNode
+		if m, err = p.parseUnary(); err == nil {
+			n = bpfAnd(n, m)
+		}
+	}
+	return n, err
+}
+
+func (p *bpfParser) parseUnary() (*bpfNode, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return bpfNot(n), nil
+	case "(":
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	}
+	return p.parsePrimitive()
+}
+
+// [proto] [src|dst] [host|net|port] value，或单独的协议
+func (p *bpfParser) parsePrimitive() (*bpfNode, error) {
+	var proto, dir, typ string
+
+	t := p.peek()
+	switch t {
+	case "ip", "ip6", "arp":
+		p.next()
+		return bpfEtherType(map[string]uint32{"ip": bpfEtherIP, "ip6": bpfEtherIPv6, "arp": bpfEtherARP}[t]), nil
+	case "icmp":
+		p.next()
+		return bpfIPProto(unix.IPPROTO_ICMP), nil
+	case "tcp", "udp":
+		p.next()
+		proto = t
+		if q := p.peek(); q != "src" && q != "dst" && q != "host" && q != "net" && q != "port" {
+			return bpfOr(bpfIPProto(bpfIPProtos[proto]), bpfIP6Proto(bpfIPProtos[proto])), nil
+		}
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = p.next()
+	}
+	if t := p.peek(); t == "host" || t == "net" || t == "port" {
+		typ = p.next()
+	}
+	value := p.next()
+	if value == "" || value == "and" || value == "or" || value == ")" {
+		return nil, fmt.Errorf("missing value after %q", strings.TrimSpace(strings.Join([]string{proto, dir, typ}, " ")))
+	}
+	if proto != "" && typ != "port" {
+		return nil, fmt.Errorf("%s only qualifies port", proto)
+	}
+
+	switch typ {
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return bpfPort(proto, dir, uint32(port)), nil
+	case "net":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 net %q", value)
+		}
+		return bpfIPNet(dir, ipnet), nil
+	default:
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 host %q", value)
+		}
+		return bpfIPNet(dir, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}), nil
+	}
+}
+
+// 带标签的指令，跳转目标在全部指令生成后计算
+type bpfProgram struct {
+	insns  []unix.SockFilter
+	jt, jf []int // 跳转指令的目标标签，-1为非跳转指令
+	labels []int
+}
+
+func (prog *bpfProgram) newLabel() int {
+	prog.labels = append(prog.labels, -1)
+	return len(prog.labels) - 1
+}
+
+func (prog *bpfProgram) mark(label int) {
+	prog.labels[label] = len(prog.insns)
+}
+
+func (prog *bpfProgram) emit(insn unix.SockFilter, jt, jf int) {
+	prog.insns = append(prog.insns, insn)
+	prog.jt = append(prog.jt, jt)
+	prog.jf = append(prog.jf, jf)
+}
+
+// 条件成立时跳转到t，否则跳转到f
+func (prog *bpfProgram) compile(n *bpfNode, t, f int) {
+	switch n.op {
+	case "and":
+		mid := prog.newLabel()
+		prog.compile(n.left, mid, f)
+		prog.mark(mid)
+		prog.compile(n.right, t, f)
+	case "or":
+		mid := prog.newLabel()
+		prog.compile(n.left, t, mid)
+		prog.mark(mid)
+		prog.compile(n.right, t, f)
+	case "not":
+		prog.compile(n.left, f, t)
+	default:
+		for _, l := range n.loads {
+			prog.emit(l, -1, -1)
+		}
+		prog.emit(bpfStmt(unix.BPF_JMP|n.jump|unix.BPF_K, n.k), t, f)
+	}
+}
+
+func (prog *bpfProgram) resolve() ([]unix.SockFilter, error) {
+	for i := range prog.insns {
+		if prog.jt[i] < 0 {
+			continue
+		}
+		for _, jump := range []struct {
+			label int
+			off   *uint8
+		}{{prog.jt[i], &prog.insns[i].Jt}, {prog.jf[i], &prog.insns[i].Jf}} {
+			d := prog.labels[jump.label] - i - 1
+			if d < 0 || d > 255 {
+				return nil, fmt.Errorf("expression too complex")
+			}
+			*jump.off = uint8(d)
+		}
+	}
+	return prog.insns, nil
+}
+
+func compileBPF(expr string, snapLen uint32) ([]unix.SockFilter, error) {
+	p := &bpfParser{tokens: tokenizeFilter(expr)}
+	n, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compile filter %q fail - %v", expr, err)
+	}
+
+	prog := &bpfProgram{}
+	accept, reject := prog.newLabel(), prog.newLabel()
+	prog.compile(n, accept, reject)
+	prog.mark(accept)
+	prog.emit(bpfStmt(unix.BPF_RET|unix.BPF_K, snapLen), -1, -1)
+	prog.mark(reject)
+	prog.emit(bpfStmt(unix.BPF_RET|unix.BPF_K, 0), -1, -1)
+
+	insns, err := prog.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("compile filter %q fail - %v", expr, err)
+	}
+	return insns, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// tcpdump的默认snaplen，与参考程序的返回值一致
+const testSnapLen = 262144
+
+// 执行cBPF程序，只实现编译器和参考程序用到的指令，越界读取时与内核一样返回0
+func runBPF(t *testing.T, prog []unix.SockFilter, pkt []byte) uint32 {
+	var a, x uint32
+	load := func(off uint32, size uint16) (uint32, bool) {
+		n := map[uint16]uint32{unix.BPF_W: 4, unix.BPF_H: 2, unix.BPF_B: 1}[size]
+		if uint64(off)+uint64(n) > uint64(len(pkt)) {
+			return 0, false
+		}
+		switch size {
+		case unix.BPF_W:
+			return binary.BigEndian.Uint32(pkt[off:]), true
+		case unix.BPF_H:
+			return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+		}
+		return uint32(pkt[off]), true
+	}
+
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch class := ins.Code & 0x07; class {
+		case unix.BPF_LD:
+			off := ins.K
+			if ins.Code&0xe0 == unix.BPF_IND {
+				off += x
+			} else if ins.Code&0xe0 != unix.BPF_ABS {
+				t.Fatalf("unsupported ld %#x", ins.Code)
+			}
+			v, ok := load(off, ins.Code&0x18)
+			if !ok {
+				return 0
+			}
+			a = v
+		case unix.BPF_LDX:
+			if ins.Code != unix.BPF_LDX|unix.BPF_B|unix.BPF_MSH {
+				t.Fatalf("unsupported ldx %#x", ins.Code)
+			}
+			v, ok := load(ins.K, unix.BPF_B)
+			if !ok {
+				return 0
+			}
+			x = (v & 0xf) * 4
+		case unix.BPF_ALU:
+			if ins.Code != unix.BPF_ALU|unix.BPF_AND|unix.BPF_K {
+				t.Fatalf("unsupported alu %#x", ins.Code)
+			}
+			a &= ins.K
+		case unix.BPF_JMP:
+			var cond bool
+			switch ins.Code {
+			case unix.BPF_JMP | unix.BPF_JA:
+				pc += int(ins.K)
+				continue
+			case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+				cond = a == ins.K
+			case unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K:
+				cond = a&ins.K != 0
+			case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+				cond = a > ins.K
+			case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+				cond = a >= ins.K
+			default:
+				t.Fatalf("unsupported jmp %#x", ins.Code)
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET:
+			return ins.K
+		default:
+			t.Fatalf("unsupported class %#x", class)
+		}
+	}
+	t.Fatalf("program falls off the end")
+	return 0
+}
+
+func testEther(typ uint16, payload []byte) []byte {
+	pkt := make([]byte, 14, 14+len(payload))
+	binary.BigEndian.PutUint16(pkt[12:], typ)
+	return append(pkt, payload...)
+}
+
+func testPorts(sport, dport uint16) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:], sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	return b
+}
+
+func testIPv4(proto byte, src, dst string, frag uint16, l4 []byte) []byte {
+	hdr := make([]byte, 20)
+	hdr[0] = 0x45
+	binary.BigEndian.PutUint16(hdr[6:], frag)
+	hdr[9] = proto
+	copy(hdr[12:], net.ParseIP(src).To4())
+	copy(hdr[16:], net.ParseIP(dst).To4())
+	return testEther(bpfEtherIP, append(hdr, l4...))
+}
+
+func testIPv6(next byte, payload []byte) []byte {
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	hdr[6] = next
+	return testEther(bpfEtherIPv6, append(hdr, payload...))
+}
+
+func testARP(typ uint16, spa, tpa string) []byte {
+	arp := make([]byte, 28)
+	copy(arp[14:], net.ParseIP(spa).To4())
+	copy(arp[24:], net.ParseIP(tpa).To4())
+	return testEther(typ, arp)
+}
+
+var testPackets = map[string][]byte{
+	"tcp-80-in":      testIPv4(unix.IPPROTO_TCP, "10.0.0.1", "10.1.2.3", 0, testPorts(80, 1234)),
+	"tcp-80-out":     testIPv4(unix.IPPROTO_TCP, "10.1.2.3", "10.0.0.2", 0, testPorts(1234, 80)),
+	"tcp-8080":       testIPv4(unix.IPPROTO_TCP, "10.1.2.3", "10.0.0.2", 0, testPorts(1234, 8080)),
+	"tcp-80-frag":    testIPv4(unix.IPPROTO_TCP, "10.0.0.1", "10.1.2.3", 0x0010, testPorts(80, 80)),
+	"udp-dns":        testIPv4(unix.IPPROTO_UDP, "10.1.2.3", "8.8.8.8", 0, testPorts(5353, 53)),
+	"udp-80":         testIPv4(unix.IPPROTO_UDP, "10.0.0.1", "10.1.0.9", 0, testPorts(80, 80)),
+	"sctp-80":        testIPv4(unix.IPPROTO_SCTP, "10.0.0.3", "10.2.0.1", 0, testPorts(80, 80)),
+	"icmp-in-net":    testIPv4(unix.IPPROTO_ICMP, "10.1.0.5", "10.0.0.1", 0, make([]byte, 8)),
+	"icmp-out-net":   testIPv4(unix.IPPROTO_ICMP, "10.2.0.5", "10.0.0.9", 0, make([]byte, 8)),
+	"ip6-tcp-80":     testIPv6(unix.IPPROTO_TCP, testPorts(1234, 80)),
+	"ip6-udp-dns":    testIPv6(unix.IPPROTO_UDP, testPorts(1234, 53)),
+	"ip6-frag-tcp":   testIPv6(unix.IPPROTO_FRAGMENT, append([]byte{unix.IPPROTO_TCP, 0, 0, 0, 0, 0, 0, 0}, testPorts(80, 80)...)),
+	"arp-host":       testARP(bpfEtherARP, "10.0.0.1", "10.1.0.1"),
+	"arp-net":        testARP(bpfEtherARP, "10.1.0.7", "10.0.0.9"),
+	"rarp-host":      testARP(bpfEtherRARP, "10.2.0.7", "10.0.0.1"),
+	"short-ethernet": make([]byte, 10),
+}
+
+// tcpdump -dd 的输出（libpcap 1.10，DLT_EN10MB）
+var tcpdumpPrograms = map[string][]unix.SockFilter{
+	"tcp port 80": {
+		{Code: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Code: 0x15, Jt: 0, Jf: 6, K: 0x000086dd},
+		{Code: 0x30, Jt: 0, Jf: 0, K: 0x00000014},
+		{Code: 0x15, Jt: 0, Jf: 15, K: 0x00000006},
+		{Code: 0x28, Jt: 0, Jf: 0, K: 0x00000036},
+		{Code: 0x15, Jt: 12, Jf: 0, K: 0x00000050},
+		{Code: 0x28, Jt: 0, Jf: 0, K: 0x00000038},
+		{Code: 0x15, Jt: 10, Jf: 11, K: 0x00000050},
+		{Code: 0x15, Jt: 0, Jf: 10, K: 0x00000800},
+		{Code: 0x30, Jt: 0, Jf: 0, K: 0x00000017},
+		{Code: 0x15, Jt: 0, Jf: 8, K: 0x00000006},
+		{Code: 0x28, Jt: 0, Jf: 0, K: 0x00000014},
+		{Code: 0x45, Jt: 6, Jf: 0, K: 0x00001fff},
+		{Code: 0xb1, Jt: 0, Jf: 0, K: 0x0000000e},
+		{Code: 0x48, Jt: 0, Jf: 0, K: 0x0000000e},
+		{Code: 0x15, Jt: 2, Jf: 0, K: 0x00000050},
+		{Code: 0x48, Jt: 0, Jf: 0, K: 0x00000010},
+		{Code: 0x15, Jt: 0, Jf: 1, K: 0x00000050},
+		{Code: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+		{Code: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+	},
+	"not host 10.0.0.1": {
+		{Code: 0x28, Jt: 0, Jf: 0, K: 0x0000000c},
+		{Code: 0x15, Jt: 0, Jf: 4, K: 0x00000800},
+		{Code: 0x20, Jt: 0, Jf: 0, K: 0x0000001a},
+		{Code: 0x15, Jt: 8, Jf: 0, K: 0x0a000001},
+		{Code: 0x20, Jt: 0, Jf: 0, K: 0x0000001e},
+		{Code: 0x15, Jt: 6, Jf: 7, K: 0x0a000001},
+		{Code: 0x15, Jt: 1, Jf: 0, K: 0x00000806},
+		{Code: 0x15, Jt: 0, Jf: 5, K: 0x00008035},
+		{Code: 0x20, Jt: 0, Jf: 0, K: 0x0000001c},
+		{Code: 0x15, Jt: 2, Jf: 0, K: 0x0a000001},
+		{Code: 0x20, Jt: 0, Jf: 0, K: 0x00000026},
+		{Code: 0x15, Jt: 0, Jf: 1, K: 0x0a000001},
+		{Code: 0x6, Jt: 0, Jf: 0, K: 0x00000000},
+		{Code: 0x6, Jt: 0, Jf: 0, K: 0x00040000},
+	},
+}
+
+// 与tcpdump生成的程序对每个报文的判定一致
+func TestCompileBPFMatchesTcpdump(t *testing.T) {
+	for expr, ref := range tcpdumpPrograms {
+		prog, err := compileBPF(expr, testSnapLen)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		for name, pkt := range testPackets {
+			if got, want := runBPF(t, prog, pkt), runBPF(t, ref, pkt); got != want {
+				t.Errorf("%s on %s: got %d, tcpdump %d", expr, name, got, want)
+			}
+		}
+	}
+}
+
+func TestCompileBPFVerdicts(t *testing.T) {
+	tests := []struct {
+		expr   string
+		accept []string
+	}{
+		{"tcp port 80", []string{"tcp-80-in", "tcp-80-out", "ip6-tcp-80"}},
+		{"port 80", []string{"tcp-80-in", "tcp-80-out", "udp-80", "sctp-80", "ip6-tcp-80"}},
+		{"udp dst port 53", []string{"udp-dns", "ip6-udp-dns"}},
+		{"tcp", []string{"tcp-80-in", "tcp-80-out", "tcp-8080", "tcp-80-frag", "ip6-tcp-80", "ip6-frag-tcp"}},
+		{"not host 10.0.0.1", []string{"tcp-80-out", "tcp-8080", "udp-dns", "sctp-80", "icmp-out-net",
+			"ip6-tcp-80", "ip6-udp-dns", "ip6-frag-tcp", "arp-net"}},
+		{"src net 10.1.0.0/16 and (udp or icmp)", []string{"udp-dns", "icmp-in-net"}},
+		{"src net 10.1.0.0/16 && !tcp", []string{"udp-dns", "icmp-in-net", "arp-net"}},
+		{"dst 10.0.0.1 or arp", []string{"icmp-in-net", "arp-host", "arp-net", "rarp-host"}},
+		{"ip6 and not udp", []string{"ip6-tcp-80", "ip6-frag-tcp"}},
+	}
+
+	for _, tt := range tests {
+		prog, err := compileBPF(tt.expr, testSnapLen)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		for name, pkt := range testPackets {
+			want := uint32(0)
+			if StringInArr(tt.accept, name) {
+				want = testSnapLen
+			}
+			if got := runBPF(t, prog, pkt); got != want {
+				t.Errorf("%s on %s: got %d, want %d", tt.expr, name, got, want)
+			}
+		}
+	}
+}
+
+func TestCompileBPFErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp src",
+		"port x",
+		"port 70000",
+		"(udp",
+		"udp)",
+		"icmp or",
+		"host 10.0.0.256",
+		"net 10.0.0.0/33",
+		"tcp host 10.0.0.1",
+		"vlan 100",
+	} {
+		if _, err := compileBPF(expr, testSnapLen); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+// 跳转距离超过255条指令时报错，不生成错误的程序
+func TestCompileBPFJumpOverflow(t *testing.T) {
+	hosts := func(n int) string {
+		var terms []string
+		for i := 1; i <= n; i++ {
+			terms = append(terms, "host 10.0.0."+strconvItoa(i))
+		}
+		return strings.Join(terms, " or ")
+	}
+
+	prog, err := compileBPF(hosts(10), testSnapLen)
+	if err != nil {
+		t.Fatalf("10 hosts: %v", err)
+	}
+	if got := runBPF(t, prog, testPackets["tcp-80-in"]); got != testSnapLen {
+		t.Errorf("10 hosts on tcp-80-in: got %d", got)
+	}
+
+	if _, err := compileBPF(hosts(40), testSnapLen); err == nil || !strings.Contains(err.Error(), "too complex") {
+		t.Errorf("40 hosts: expected too complex error, got %v", err)
+	}
+}
+
+func strconvItoa(i int) string {
+	return net.IPv4(0, 0, 0, byte(i)).To4().String()[len("0.0.0."):]
+}
+
+func TestHtons(t *testing.T) {
+	b := make([]byte, 2)
+	nl.NativeEndian().PutUint16(b, htons(unix.ETH_P_ARP))
+	if !bytes.Equal(b, []byte{0x08, 0x06}) {
+		t.Errorf("htons(0x0806) in memory = % x", b)
+	}
+}
+
+func TestWritePcap(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePcapHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456000)
+	data := testPackets["udp-dns"]
+	if err := writePcapPacket(&buf, ts, data, 1500); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.Bytes()
+	if len(out) != 24+16+len(data) {
+		t.Fatalf("pcap length %d", len(out))
+	}
+	le := binary.LittleEndian
+	if !bytes.Equal(out[0:4], []byte{0xd4, 0xc3, 0xb2, 0xa1}) {
+		t.Errorf("magic % x", out[0:4])
+	}
+	if le.Uint16(out[4:]) != 2 || le.Uint16(out[6:]) != 4 {
+		t.Errorf("version %d.%d", le.Uint16(out[4:]), le.Uint16(out[6:]))
+	}
+	if le.Uint32(out[16:]) != captureSnapLen || le.Uint32(out[20:]) != 1 {
+		t.Errorf("snaplen %d linktype %d", le.Uint32(out[16:]), le.Uint32(out[20:]))
+	}
+
+	rec := out[24:]
+	if le.Uint32(rec[0:]) != 1700000000 || le.Uint32(rec[4:]) != 123456 {
+		t.Errorf("timestamp %d.%06d", le.Uint32(rec[0:]), le.Uint32(rec[4:]))
+	}
+	if le.Uint32(rec[8:]) != uint32(len(data)) || le.Uint32(rec[12:]) != 1500 {
+		t.Errorf("incl %d orig %d", le.Uint32(rec[8:]), le.Uint32(rec[12:]))
+	}
+	if !bytes.Equal(rec[16:], data) {
+		t.Errorf("packet data differs")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	captureSnapLen     = 65535
+	captureMaxDuration = 5 * time.Minute
+	captureDefDuration = 10 * time.Second
+)
+
+/*
+在pod网络命名空间内抓包，以pcap格式返回，需要以 -enable-capture 启动glued：
+	curl -o pod.pcap "http://127.0.0.1:9750/capture?namespace=default&pod=nginx&filter=tcp+port+80&duration=30s&count=1000"
+
+macvlan/ipvlan的pod流量不经过主机的veth，只能进入pod的网络命名空间抓包
+	namespace/pod: 必选
+	filter: 可选，过滤表达式，支持tcpdump语法的常用子集，见bpf.go
+	duration: 可选，抓包时长，默认10s，最长5m
+	count: 可选，抓包个数，到达后立即返回
+抓包可以看到pod的全部流量，默认关闭
+*/
+
+// 在pod命名空间中创建AF_PACKET socket，socket创建后即与命名空间绑定
+func openPodCapture(rec *PodRecord, filter string) (int, error) {
+	var insns []unix.SockFilter
+	if filter != "" {
+		var err error
+		if insns, err = compileBPF(filter, captureSnapLen); err != nil {
+			return -1, err
+		}
+	}
+
+	fd := -1
+	err := DoInPodNetns(rec, func() error {
+		link, err := netlink.LinkByName(rec.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to get pod device %q: %v", rec.IfName, err)
+		}
+
+		proto := int(htons(unix.ETH_P_ALL))
+		sock, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return fmt.Errorf("create packet socket fail - %v", err)
+		}
+
+		if len(insns) > 0 {
+			prog := &unix.SockFprog{Len: uint16(len(insns)), Filter: &insns[0]}
+			if err := unix.SetsockoptSockFprog(sock, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, prog); err != nil {
+				unix.Close(sock)
+				return fmt.Errorf("attach filter fail - %v", err)
+			}
+		}
+
+		sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Attrs().Index}
+		if err := unix.Bind(sock, sa); err != nil {
+			unix.Close(sock)
+			return fmt.Errorf("bind packet socket fail - %v", err)
+		}
+
+		// 定时返回，用于检查抓包是否结束
+		tv := unix.Timeval{Sec: 1}
+		unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+
+		fd = sock
+		return nil
+	})
+	return fd, err
+}
+
+// 主机字节序转为网络字节序，与主机大小端无关
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return nl.NativeEndian().Uint16(b)
+}
+
+func writePcapHeader(w io.Writer) error {
+	hdr := struct {
+		Magic        uint32
+		VersionMajor uint16
+		VersionMinor uint16
+		ThisZone     int32
+		SigFigs      uint32
+		SnapLen      uint32
+		LinkType     uint32
+	}{0xa1b2c3d4, 2, 4, 0, 0, captureSnapLen, 1} // LINKTYPE_ETHERNET
+	return binary.Write(w, binary.LittleEndian, &hdr)
+}
+
+func writePcapPacket(w io.Writer, ts time.Time, data []byte, origLen int) error {
+	hdr := struct {
+		TsSec   uint32
+		TsUsec  uint32
+		InclLen uint32
+		OrigLen uint32
+	}{uint32(ts.Unix()), uint32(ts.Nanosecond() / 1000), uint32(len(data)), uint32(origLen)}
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	if !*argEnableCapture {
+		http.Error(w, "capture disabled, start glued with -enable-capture", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	namespace, name := q.Get("namespace"), q.Get("pod")
+	if namespace == "" || name == "" {
+		http.Error(w, "namespace and pod are required", http.StatusBadRequest)
+		return
+	}
+
+	duration := captureDefDuration
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	if duration > captureMaxDuration {
+		duration = captureMaxDuration
+	}
+
+	count := 0
+	if v := q.Get("count"); v != "" {
+		c, err := strconv.Atoi(v)
+		if err != nil || c < 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+		count = c
+	}
+
+	rec, err := FindPodRecord(namespace, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	fd, err := openPodCapture(rec, q.Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unix.Close(fd)
+
+	fmt.Printf("Capture: start capture pod %s/%s, filter [%s], duration %v, count %d\n",
+		namespace, name, q.Get("filter"), duration, count)
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s.pcap", namespace, name))
+	if err := writePcapHeader(w); err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+
+	buf := make([]byte, captureSnapLen)
+	deadline := time.Now().Add(duration)
+	captured := 0
+	for time.Now().Before(deadline) && (count == 0 || captured < count) {
+		select {
+		case <-r.Context().Done():
+			fmt.Printf("Capture: client closed, captured %d packets\n", captured)
+			return
+		default:
+		}
+
+		n, _, err := unix.Recvfrom(fd, buf, unix.MSG_TRUNC)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			fmt.Printf("Capture: recv fail - %v\n", err)
+			break
+		}
+
+		incl := n
+		if incl > len(buf) {
+			incl = len(buf)
+		}
+		if err := writePcapPacket(w, time.Now(), buf[:incl], n); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		captured++
+	}
+
+	fmt.Printf("Capture: capture pod %s/%s done, %d packets\n", namespace, name, captured)
+}
+
+func init() {
+	RegisterAPI("/capture", captureHandler)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultCNIConfFile    = "/etc/cni/net.d/10-glue.conflist"
+	defaultCNINetworkName = "glue-net"
+	defaultCNIPlugins     = "portmap"
+)
+
+/*
+数据面就绪后生成CNI配置，kubelet在配置文件出现后才认为节点网络就绪：
+
+	{
+	  "name": "glue-net",
+	  "cniVersion": "1.0.0",
+	  "plugins": [
+	    {"type": "glue"},
+	    {"type": "portmap", "capabilities": {"portMappings": true}}
+	  ]
+	}
+
+glue之后可以串联portmap、bandwidth、tuning，通过 -cni-plugins 指定。
+配置文件原子写入，内容不变时不重写；数据面检查（device、nat、tc、subnet-file）失败时删除，新建的pod等待网络恢复。
+watch中断或安装文件变化不影响已有数据面，不删除配置
+*/
+var (
+	cniConfLock    sync.Mutex
+	cniConfWritten bool
+)
+
+var cniChainedPlugins = map[string]map[string]interface{}{
+	"portmap":   {"type": "portmap", "capabilities": map[string]bool{"portMappings": true}},
+	"bandwidth": {"type": "bandwidth", "capabilities": map[string]bool{"bandwidth": true}},
+	"tuning":    {"type": "tuning"},
+}
+
+func ParseCNIPlugins(s string) ([]string, error) {
+	var plugins []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := cniChainedPlugins[name]; !ok {
+			return nil, fmt.Errorf("chained plugin %s not supported, only support portmap/bandwidth/tuning", name)
+		}
+		plugins = append(plugins, name)
+	}
+	return plugins, nil
+}
+
+// glue插件的配置，路径使用默认值时不写入，由插件按默认值和节点命名空间推导
+func renderCNIConf() []byte {
+	glue := map[string]interface{}{"type": "glue"}
+	subnetFile, podsDir := defaultSubnetFile, defaultPodsDir
+	if glueNetns != nil {
+		glue["nodeNetns"] = *argNetns
+		name := filepath.Base(*argNetns)
+		subnetFile = filepath.Join(glueRunDir, name, filepath.Base(defaultSubnetFile))
+		podsDir = filepath.Join(glueRunDir, name, filepath.Base(defaultPodsDir))
+	}
+	if *argSubnetFile != subnetFile {
+		glue["subnetFile"] = *argSubnetFile
+	}
+	if *argPodsDir != podsDir {
+		glue["podsDir"] = *argPodsDir
+	}
+
+	plugins := []interface{}{glue}
+	names, _ := ParseCNIPlugins(*argCNIPlugins)
+	for _, name := range names {
+		plugins = append(plugins, cniChainedPlugins[name])
+	}
+
+	conf := map[string]interface{}{
+		"name":       *argCNINetworkName,
+		"cniVersion": *argCNIVersion,
+		"plugins":    plugins,
+	}
+	buf, _ := json.MarshalIndent(conf, "", "  ")
+	return append(buf, '\n')
+}
+
+// 根据节点网络状态写入或删除CNI配置
+func SyncCNIConf(glueErr error) {
+	if *argCNIConfFile == "" || *argDryRun {
+		return
+	}
+
+	ready, detail := glueErr == nil, ""
+	if glueErr != nil {
+		detail = glueErr.Error()
+	} else {
+		inGlueNetns(func() error {
+			ready, detail = runChecks(dataPlaneChecks)
+			return nil
+		})
+	}
+
+	cniConfLock.Lock()
+	defer cniConfLock.Unlock()
+
+	if !ready {
+		if err := os.Remove(*argCNIConfFile); err == nil {
+			fmt.Printf("CNIConf: node network not ready, remove %s\n%s\n", *argCNIConfFile, strings.TrimSpace(detail))
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("CNIConf: remove %s fail - %v\n", *argCNIConfFile, err)
+		}
+		cniConfWritten = false
+		return
+	}
+
+	desired := renderCNIConf()
+	if cur, err := ioutil.ReadFile(*argCNIConfFile); err == nil && bytes.Equal(cur, desired) {
+		cniConfWritten = true
+		return
+	}
+	if err := writeFileAtomic(*argCNIConfFile, desired, 0644); err != nil {
+		fmt.Printf("CNIConf: %v\n", err)
+		return
+	}
+	if !cniConfWritten {
+		fmt.Printf("CNIConf: node network ready, write %s\n", *argCNIConfFile)
+	}
+	cniConfWritten = true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 原始方向或应答方向中包含指定地址段的conntrack表项
+type conntrackCIDRFilter struct {
+	cidrs []*net.IPNet
+}
+
+func (f *conntrackCIDRFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	for _, c := range f.cidrs {
+		if c.Contains(flow.Forward.SrcIP) || c.Contains(flow.Forward.DstIP) ||
+			c.Contains(flow.Reverse.SrcIP) || c.Contains(flow.Reverse.DstIP) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+NodeCIDR变化后旧地址段中的pod全部删除、glue设备的旧地址移除时，删除相关的conntrack表项：
+
+	conntrack -D -s 172.24.0.0/24
+	conntrack -D -d 172.24.0.0/24
+*/
+func FlushConntrackCIDR(cidr string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+
+	family := netlink.InetFamily(netlink.FAMILY_V4)
+	if ipnet.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, &conntrackCIDRFilter{cidrs: []*net.IPNet{ipnet}})
+	if err != nil {
+		return fmt.Errorf("flush conntrack for %s fail - %v", cidr, err)
+	}
+	fmt.Printf("Conntrack: flushed %d entries of %s\n", n, cidr)
+	return nil
+}
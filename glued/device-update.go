@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// glue设备的模式是否与配置一致
+func glueModeMatch(link netlink.Link, conf GlueSubnetConf) bool {
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		return l.Mode == mapMacvlanMode(conf.Master.Mode)
+	case *netlink.IPVlan:
+		return l.Mode == mapIPVlanMode(conf.Master.Mode)
+	}
+	return false
+}
+
+// 修改glue设备的模式，内核支持macvlan/ipvlan的changelink
+func setGlueMode(link netlink.Link, conf GlueSubnetConf) error {
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		l.Mode = mapMacvlanMode(conf.Master.Mode)
+	case *netlink.IPVlan:
+		l.Mode = mapIPVlanMode(conf.Master.Mode)
+	default:
+		return fmt.Errorf("unsupported device type %s", link.Type())
+	}
+	return (&netlink.Handle{}).LinkModify(link)
+}
+
+// NodeCIDR变化后的旧地址段，旧地址删除时清理其conntrack表项
+var (
+	retiredLock      sync.Mutex
+	retiredNodeCIDRs []string
+)
+
+func RetireNodeCIDR(cidr string) {
+	retiredLock.Lock()
+	defer retiredLock.Unlock()
+	if !StringInArr(retiredNodeCIDRs, cidr) {
+		retiredNodeCIDRs = append(retiredNodeCIDRs, cidr)
+	}
+}
+
+// 查找glue地址对应的旧NodeCIDR，remove为true时从记录中删除
+func retiredNodeNet(ip net.IP, conf GlueSubnetConf, remove bool) *net.IPNet {
+	retiredLock.Lock()
+	defer retiredLock.Unlock()
+
+	for i, cidr := range retiredNodeCIDRs {
+		old := conf
+		old.NodeCIDR = cidr
+		addr, err := getGlueAddr(old)
+		if err != nil || !addr.IP.Equal(ip) {
+			continue
+		}
+		if remove {
+			retiredNodeCIDRs = append(retiredNodeCIDRs[:i], retiredNodeCIDRs[i+1:]...)
+		}
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		return ipnet
+	}
+	return nil
+}
+
+/*
+glue设备的旧地址是否仍被pod使用：
+  - macvlan的pod以glue地址为网关，pod记录中带有网关地址时按网关判断
+  - ipvlan的pod网关为podCIDR中的保留地址，按旧NodeCIDR中是否还有pod地址判断
+  - 旧版本插件的记录没有网关，或旧NodeCIDR未知（重启后），地址不在当前NodeCIDR中的pod视为使用旧地址
+*/
+func glueAddrInUse(ip net.IP, conf GlueSubnetConf) bool {
+	recs, err := ListPodRecords()
+	if err != nil {
+		// 无法判断时保留
+		return true
+	}
+
+	_, nodeNet, _ := net.ParseCIDR(conf.NodeCIDR)
+	oldNet := retiredNodeNet(ip, conf, false)
+	for _, rec := range recs {
+		if conf.Master.Type == "macvlan" && rec.Gateway != "" {
+			if rec.Gateway == ip.String() {
+				return true
+			}
+			continue
+		}
+		for _, s := range rec.IPs {
+			podIP := net.ParseIP(s)
+			if podIP == nil || podIP.To4() == nil {
+				continue
+			}
+			if oldNet != nil {
+				if oldNet.Contains(podIP) {
+					return true
+				}
+				continue
+			}
+			if nodeNet == nil || !nodeNet.Contains(podIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func syncGlueAddrs(link netlink.Link, conf GlueSubnetConf, fixed func(format string, args ...interface{})) error {
+	addr, err := getGlueAddr(conf)
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			found = true
+		}
+	}
+	if !found {
+		fixed("add address %s to glue device", addr.IPNet.String())
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+	}
+
+	// 旧地址保留到使用它作为网关的pod全部删除
+	for i := range addrs {
+		a := addrs[i]
+		if a.IPNet.String() == addr.IPNet.String() || glueAddrInUse(a.IP, conf) {
+			continue
+		}
+		fixed("remove unused address %s from glue device", a.IPNet.String())
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+
+		// 旧地址段已无pod使用，清理其conntrack表项；pod删除时插件已清理各自的表项
+		if oldNet := retiredNodeNet(a.IP, conf, true); oldNet != nil {
+			if err := FlushConntrackCIDR(oldNet.String()); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+对比已有glue设备与期望配置，原地修改：
+  - 类型或父接口变化：重建设备
+  - 模式变化：changelink修改模式，失败时重建
+  - MTU与master不一致：修改MTU
+  - 地址：添加新地址，旧地址在pod不再使用后删除
+*/
+func syncGlueLink(conf GlueSubnetConf, fixed func(format string, args ...interface{})) error {
+	parent, err := netlink.LinkByName(conf.Master.Master)
+	if err != nil {
+		return fmt.Errorf("get master %s fail - %v", conf.Master.Master, err)
+	}
+
+	link, err := netlink.LinkByName(DefaltGlueDeviceName)
+	if err == nil && (link.Type() != conf.Master.Type || link.Attrs().ParentIndex != parent.Attrs().Index) {
+		fixed("glue device type %s parent %d changed, recreate", link.Type(), link.Attrs().ParentIndex)
+		if err := CleanDevices(); err != nil {
+			return fmt.Errorf("ERROR: CleanDevices old config fail - %v\n", err)
+		}
+		link = nil
+	} else if err == nil && !glueModeMatch(link, conf) {
+		fixed("change glue device mode to %s", conf.Master.Mode)
+		if err := setGlueMode(link, conf); err != nil {
+			fixed("change mode fail - %v, recreate", err)
+			if err := CleanDevices(); err != nil {
+				return fmt.Errorf("ERROR: CleanDevices old config fail - %v\n", err)
+			}
+			link = nil
+		}
+	} else if err != nil {
+		link = nil
+	}
+
+	if link == nil {
+		fixed("create glue device")
+		if err := AddDevice(conf); err != nil {
+			return fmt.Errorf("ERROR: Add glue device fail, err=%+v\n", err)
+		}
+	}
+
+	link, err = netlink.LinkByName(DefaltGlueDeviceName)
+	if err != nil {
+		return fmt.Errorf("Cannot get glue device err = %v", err)
+	}
+
+	if link.Attrs().MTU != parent.Attrs().MTU {
+		fixed("set glue device mtu %d -> %d", link.Attrs().MTU, parent.Attrs().MTU)
+		if err := netlink.LinkSetMTU(link, parent.Attrs().MTU); err != nil {
+			return err
+		}
+	}
+
+	if err := syncGlueAddrs(link, conf, fixed); err != nil {
+		return err
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		fixed("set glue device up")
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
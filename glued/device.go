@@ -116,14 +116,14 @@ func getNetInfo(subnet *GlueSubnetConf) (rangStart net.IP, rangeEnd net.IP, node
 }
 
 func AddDevice(conf GlueSubnetConf) error {
-	link,err := netlink.LinkByName(conf.Master.Master)
+	parent,err := netlink.LinkByName(conf.Master.Master)
 	if (err != nil){
 		return err
 	}
 
 	la := netlink.NewLinkAttrs()
 	la.Name = DefaltGlueDeviceName
-	la.ParentIndex = link.Attrs().Index
+	la.ParentIndex = parent.Attrs().Index
 
 	if conf.Master.Type == "macvlan" {
 		fmt.Printf("AddDevice: start add macvlan device...\n")
@@ -137,7 +137,9 @@ func AddDevice(conf GlueSubnetConf) error {
 		}
 
 		// 设置父接口为混杂模式
-		netlink.SetPromiscOn(link)
+		if _, err := ensurePromisc(parent); err != nil {
+			fmt.Printf("AddDevice: %v\n", err)
+		}
 		fmt.Printf("AddDevice: add macvlan device success\n")
 		return nil
 	}
@@ -163,56 +165,55 @@ func AddDevice(conf GlueSubnetConf) error {
 
 
 /*
-// 在 PREROUTING 链上增加规则
+// 在 PREROUTING 链上增加规则，pod经glue设备访问服务的流量打上标记
 iptables -t nat -N GLUE-PREROUTING
 iptables -t nat -I PREROUTING -j GLUE-PREROUTING
-iptables -t nat -A GLUE-PREROUTING -s 172.24.0.0/24 -d 172.23.0.0/24 -i glue -j KUBE-MARK-MASQ
+iptables -t nat -A GLUE-PREROUTING -s 172.24.0.0/24 -d 172.23.0.0/24 -i glue -j MARK --set-xmark 0x1000/0x1000
+
+// 在 POSTROUTING 链上增加规则，对带标记的流量和pod访问集群外的流量做SNAT
+iptables -t nat -N GLUE-POSTROUTING
+iptables -t nat -I POSTROUTING -j GLUE-POSTROUTING
+iptables -t nat -A GLUE-POSTROUTING -m mark --mark 0x1000/0x1000 -j MASQUERADE
+iptables -t nat -A GLUE-POSTROUTING ! -s 172.24.0.0/24 -j RETURN
+iptables -t nat -A GLUE-POSTROUTING -d 10.0.0.0/8 -j RETURN
+iptables -t nat -A GLUE-POSTROUTING -j MASQUERADE
 */
- func UpdateIptables(conf GlueSubnetConf) error {
- 	fmt.Printf("Update iptables...\n")
-	ipt, err := iptables.New()
-	if err!=nil {
-		fmt.Printf("Get iptables handler fail - %v\n", err);
-		return err
-	}
 
-	fmt.Printf("check iptables rules...\n")
-	isExists, err := ipt.ChainExists("nat", DefaultGluePREChainName)
-	if err==nil && isExists {
-		fmt.Printf("iptables rules exist, skip...\n");
-		return nil
-	}
-
-	err = ipt.NewChain("nat", DefaultGluePREChainName)
+// 检查glue的iptables规则是否与期望一致
+func CheckIptables(conf GlueSubnetConf) error {
+	ipt, err := iptables.New()
 	if err!=nil {
-		fmt.Printf("iptables create chain %v fail - %v\n", DefaultGluePREChainName, err);
 		return err
 	}
 
-	err = ipt.Append("nat", DefaultGluePREChainName, 
-						"-s", conf.NodeCIDR, 
-						"-d", conf.ServiceCIDR, 
-						"-i", DefaltGlueDeviceName, "-j", "KUBE-MARK-MASQ")
-	if err!=nil {
-		fmt.Printf("iptables append rule to chain %v fail - %v\n", DefaultGluePREChainName, err);
+	diffs, err := diffIptables(ipt, conf)
+	if err != nil {
 		return err
 	}
-
-	err = ipt.Insert("nat", "PREROUTING", 1, "-j", DefaultGluePREChainName)
-	if err!=nil {
-		fmt.Printf("iptables insert chain %v to PREROUTING fail\n", DefaultGluePREChainName);
-		return err
+	for _, d := range diffs {
+		if !d.ChainExists {
+			return fmt.Errorf("chain %s not found", d.Chain)
+		}
+		if d.RulesChanged() {
+			return fmt.Errorf("rules in chain %s are out of date", d.Chain)
+		}
+		if d.JumpMissing {
+			return fmt.Errorf("jump to %s not found in %s", d.Chain, d.JumpFrom)
+		}
 	}
-
-	fmt.Printf("iptables rules update success\n")
 	return nil
 }
 
 /*
-// 在 PREROUTING 链上删除规则
+// 在 PREROUTING/POSTROUTING 链上删除规则
 iptables -t nat -D PREROUTING -j GLUE-PREROUTING
 iptables -t nat -F GLUE-PREROUTING
 iptables -t nat -X GLUE-PREROUTING
+iptables -t nat -D POSTROUTING -j GLUE-POSTROUTING
+iptables -t nat -F GLUE-POSTROUTING
+iptables -t nat -X GLUE-POSTROUTING
+iptables -t nat -F GLUE-EGRESS
+iptables -t nat -X GLUE-EGRESS
 */
 func CleanIptables() error {
  	fmt.Printf("Clean iptables...\n")
@@ -226,54 +227,35 @@ func CleanIptables() error {
 	ipt.Delete("nat", "PREROUTING", "-j", DefaultGluePREChainName)
 	ipt.ClearChain("nat", DefaultGluePREChainName)
 	ipt.DeleteChain("nat", DefaultGluePREChainName)
+	ipt.Delete("nat", "POSTROUTING", "-j", DefaultGluePOSTChainName)
+	ipt.ClearChain("nat", DefaultGluePOSTChainName)
+	ipt.DeleteChain("nat", DefaultGluePOSTChainName)
+	ipt.ClearChain("nat", DefaultGlueEgressChainName)
+	ipt.DeleteChain("nat", DefaultGlueEgressChainName)
 
 	return nil
 }
 
 func UpdateGlueDev(conf GlueSubnetConf) (error) {
 	fmt.Printf("Update Glue Device..\n")
-	if err := CleanDevices(); err != nil {
-		return fmt.Errorf("ERROR: CleanDevices old config fail - %v\n", err)
-	}
-
-	err := AddDevice(conf)
-	if err != nil {
-		fmt.Printf("AddDevice: Add glue device failed, err = %v\n", err)
-		return fmt.Errorf("ERROR: Add glue device fail, err=%+v\n", err)
-	}
-	
-	glueDev, err := netlink.LinkByName(DefaltGlueDeviceName) 
-	if err!=nil {
-		fmt.Printf("AddDevice: Cannot get glue device err = %v\n", err)
+	if err := recordReconcile("device", updateGlueLink(conf)); err != nil {
 		return err
 	}
 
-	_, _, nodeIP, _, _, err := getNetInfo(&conf)
-	if err != nil {
-		return err
-	}
+	// 更新podCIDR的策略路由
+	recordReconcile("route", UpdateGlueRoutes(conf))
 
-	// 配置本机地址，直接使用pod掩码
-	_, myip, _ := net.ParseCIDR(conf.PodCIDR)
-	myip.IP = nodeIP
-	
-	fmt.Printf("Set Glue Device addr as %s\n", myip.String())
+	// 设置主机参数，glue设备的参数在设备创建后设置
+	recordReconcile("sysctl", ApplyHostSettings(conf, func(format string, args ...interface{}) {
+		fmt.Printf("HostSettings: %s\n", fmt.Sprintf(format, args...))
+	}))
 
-	addr, _:= netlink.ParseAddr(myip.String())
-	err = netlink.AddrAdd(glueDev, addr)
-	if err != nil {
-		fmt.Printf("AddDevice: Add addr failed, err = %v\n", err)
-	}
-
-	// 使能设备
-	netlink.LinkSetUp(glueDev)
-
-	// 更新iptables配置
-	UpdateIptables(conf)
+	// 更新地址转换规则
+	recordReconcile("nat", UpdateNat(conf))
 
 	// 更新ipvlan配置
 	if conf.Master.Type == "ipvlan" {
-		err = UpdateIpvlanTcConfig(conf)
+		err := recordReconcile("tc", UpdateIpvlanTcConfig(conf))
 		if err != nil{
 			fmt.Printf("update ipvlan paras failed\n")
 			return fmt.Errorf("update ipvlan paras failed\n")
@@ -283,25 +265,64 @@ func UpdateGlueDev(conf GlueSubnetConf) (error) {
 	return nil
 }
 
+// glue设备地址，直接使用pod掩码
+func getGlueAddr(conf GlueSubnetConf) (*netlink.Addr, error) {
+	_, _, nodeIP, _, _, err := getNetInfo(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	_, myip, err := net.ParseCIDR(conf.PodCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("parse pod CIDR failed")
+	}
+	myip.IP = nodeIP
+	return &netlink.Addr{IPNet: myip}, nil
+}
+
+// 原地更新glue设备，仅在类型或父接口变化时重建
+func updateGlueLink(conf GlueSubnetConf) error {
+	return syncGlueLink(conf, func(format string, args ...interface{}) {
+		fmt.Printf("UpdateDevice: %s\n", fmt.Sprintf(format, args...))
+	})
+}
+
+// 选择main表中metric最小的默认路由所在网卡，metric相同的多条默认路由视为无法确定
 func GetDefaultGatewayInterface() (string, error) {
 	routes, err := netlink.RouteList(nil, syscall.AF_INET)
 	if err != nil {
 		return "", err
 	}
 
+	var best []netlink.Route
 	for _, route := range routes {
 		if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
 			if route.LinkIndex <= 0 {
 				return "", errors.New("Found default route but could not determine interface")
 			}
-			intf, err := net.InterfaceByIndex(route.LinkIndex)
-			if err != nil {
-				return "", errors.New("Cannot get interface name")
+			if len(best) == 0 || route.Priority < best[0].Priority {
+				best = []netlink.Route{route}
+			} else if route.Priority == best[0].Priority && route.LinkIndex != best[0].LinkIndex {
+				best = append(best, route)
 			}
+		}
+	}
 
-			return intf.Name, nil
+	if len(best) == 0 {
+		return "", errors.New("Unable to find default route")
+	}
+
+	var names []string
+	for _, route := range best {
+		intf, err := net.InterfaceByIndex(route.LinkIndex)
+		if err != nil {
+			return "", errors.New("Cannot get interface name")
 		}
+		names = append(names, intf.Name)
+	}
+	if len(names) > 1 {
+		return "", fmt.Errorf("Found default routes with the same metric on %v, use a 'stick-cni-master' selector", names)
 	}
 
-	return "", errors.New("Unable to find default route")
+	return names[0], nil
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	planAdd    = "add"
+	planDelete = "delete"
+	planChange = "change"
+	planKeep   = "keep"
+)
+
+// 预演模式中的一项修改
+type planItem struct {
+	Component string `json:"component"`
+	Action    string `json:"action"`
+	Object    string `json:"object"`
+	Current   string `json:"current,omitempty"`
+	Desired   string `json:"desired,omitempty"`
+}
+
+type dryRunPlan struct {
+	Config   GlueSubnetConf `json:"config"`
+	GlueAddr string         `json:"glueAddr"`
+	Changes  []planItem     `json:"changes"`
+	Errors   []string       `json:"errors,omitempty"`
+}
+
+func (p *dryRunPlan) add(component, action, object, current, desired string) {
+	p.Changes = append(p.Changes, planItem{Component: component, Action: action, Object: object, Current: current, Desired: desired})
+}
+
+func (p *dryRunPlan) fail(component string, err error) {
+	p.Errors = append(p.Errors, fmt.Sprintf("%s: %v", component, err))
+}
+
+func glueDeviceSpec(conf GlueSubnetConf, mtu int) string {
+	return fmt.Sprintf("%s parent %s mode %s mtu %d", conf.Master.Type, conf.Master.Master, conf.Master.Mode, mtu)
+}
+
+func planDevice(p *dryRunPlan, conf GlueSubnetConf) {
+	parent, err := netlink.LinkByName(conf.Master.Master)
+	if err != nil {
+		p.fail("device", fmt.Errorf("get master %s fail - %v", conf.Master.Master, err))
+		return
+	}
+	desired := glueDeviceSpec(conf, parent.Attrs().MTU)
+
+	link, err := netlink.LinkByName(DefaltGlueDeviceName)
+	if err != nil {
+		p.add("device", planAdd, DefaltGlueDeviceName, "", desired)
+		return
+	}
+
+	parentName := strconv.Itoa(link.Attrs().ParentIndex)
+	if pl, err := netlink.LinkByIndex(link.Attrs().ParentIndex); err == nil {
+		parentName = pl.Attrs().Name
+	}
+	mode := ""
+	switch l := link.(type) {
+	case *netlink.Macvlan:
+		mode = fmt.Sprintf("%d", l.Mode)
+	case *netlink.IPVlan:
+		mode = fmt.Sprintf("%d", l.Mode)
+	}
+	current := fmt.Sprintf("%s parent %s mode(%s) mtu %d", link.Type(), parentName, mode, link.Attrs().MTU)
+
+	switch {
+	case link.Type() != conf.Master.Type || link.Attrs().ParentIndex != parent.Attrs().Index:
+		p.add("device", planChange, DefaltGlueDeviceName+" (recreate)", current, desired)
+	case !glueModeMatch(link, conf) || link.Attrs().MTU != parent.Attrs().MTU:
+		p.add("device", planChange, DefaltGlueDeviceName+" (in place)", current, desired)
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		p.add("device", planChange, DefaltGlueDeviceName+" state", "down", "up")
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		p.fail("address", err)
+		return
+	}
+	found := false
+	for _, a := range addrs {
+		if a.IPNet.String() == p.GlueAddr {
+			found = true
+			continue
+		}
+		if glueAddrInUse(a.IP, conf) {
+			p.add("address", planKeep, a.IPNet.String(), "in use by pods", "delete when unused")
+		} else {
+			p.add("address", planDelete, a.IPNet.String(), a.IPNet.String(), "")
+		}
+	}
+	if !found {
+		p.add("address", planAdd, p.GlueAddr, "", p.GlueAddr+" dev "+DefaltGlueDeviceName)
+	}
+}
+
+func planRoutes(p *dryRunPlan, conf GlueSubnetConf) {
+	if _, err := netlink.LinkByName(DefaltGlueDeviceName); err != nil {
+		p.add("route", planAdd, fmt.Sprintf("table %d", *argRouteTable), "", "podCIDR rules and route, after glue device creation")
+		return
+	}
+	rules, routes, err := desiredGlueRoutes(conf)
+	if err != nil {
+		p.fail("route", err)
+		return
+	}
+	changes, err := applyGlueRoutes(rules, routes, true)
+	if err != nil {
+		p.fail("route", err)
+	}
+	for _, c := range changes {
+		kv := strings.SplitN(c, " ", 2)
+		if kv[0] == "add" {
+			p.add("route", planAdd, kv[1], "", kv[1])
+		} else {
+			p.add("route", planDelete, kv[1], kv[1], "")
+		}
+	}
+}
+
+func planTc(p *dryRunPlan, conf GlueSubnetConf) {
+	if conf.Master.Type != "ipvlan" {
+		return
+	}
+	exists, err := IpvlanTcConfigExists(conf)
+	if err != nil {
+		p.fail("tc", err)
+	}
+	if !exists {
+		p.add("tc", planAdd, conf.Master.Master+" egress", "",
+			fmt.Sprintf("u32 match ip dst %s action mirred egress redirect dev %s", conf.ServiceCIDR, DefaltGlueDeviceName))
+	}
+}
+
+func planSysctls(p *dryRunPlan, conf GlueSubnetConf) {
+	for _, s := range desiredSysctls(conf) {
+		name := strings.ReplaceAll(s.Key, "/", ".")
+		cur, err := readSysctl(s.Key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				p.add("sysctl", planAdd, name, "", strconv.Itoa(s.Value)+" (after device creation)")
+			} else {
+				p.fail("sysctl", err)
+			}
+			continue
+		}
+		if !sysctlSatisfied(s, cur) {
+			p.add("sysctl", planChange, name, cur, strconv.Itoa(s.Value))
+		}
+	}
+
+	if conf.Master.Type == "macvlan" {
+		if master, err := netlink.LinkByName(conf.Master.Master); err == nil && master.Attrs().Promisc == 0 {
+			p.add("sysctl", planChange, conf.Master.Master+" promisc", "off", "on")
+		}
+	}
+}
+
+func planCNIConf(p *dryRunPlan) {
+	if *argCNIConfFile == "" {
+		return
+	}
+	desired := strings.TrimSpace(string(renderCNIConf()))
+	buf, err := ioutil.ReadFile(*argCNIConfFile)
+	if err != nil {
+		p.add("cni-conf", planAdd, *argCNIConfFile, "", desired+" (after data plane ready)")
+		return
+	}
+	if strings.TrimSpace(string(buf)) != desired {
+		p.add("cni-conf", planChange, *argCNIConfFile, strings.TrimSpace(string(buf)), desired)
+	}
+}
+
+func planSubnetFile(p *dryRunPlan, conf GlueSubnetConf) {
+	desired, _ := json.Marshal(conf)
+	buf, err := ioutil.ReadFile(*argSubnetFile)
+	if err != nil {
+		p.add("subnet-file", planAdd, *argSubnetFile, "", string(desired))
+		return
+	}
+	if strings.TrimSpace(string(buf)) != string(desired) {
+		p.add("subnet-file", planChange, *argSubnetFile, strings.TrimSpace(string(buf)), string(desired))
+	}
+}
+
+// 确定本节点的子网配置，与正常启动时的来源相同，只读取不修改
+func resolveDryRunConf() error {
+	subnetConf.PodCIDR = *argPodCIDR
+	subnetConf.ServiceCIDR = *argServiceCIDR
+	subnetConf.NodeCIDR = *argNodeCIDR
+	if subnetConf.PodCIDR != "" {
+		return nil
+	}
+
+	clientset, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	conf, err := getClusterCIDR(clientset)
+	if err != nil {
+		return err
+	}
+	subnetConf.PodCIDR = conf.Networking.PodSubnet
+	subnetConf.ServiceCIDR = conf.Networking.ServiceSubnet
+
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), getNodeName(), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node %s fail - %v", getNodeName(), err)
+	}
+	if node.Spec.PodCIDR == "" {
+		return fmt.Errorf("node %s has no podCIDR yet", getNodeName())
+	}
+	subnetConf.NodeCIDR = node.Spec.PodCIDR
+	return nil
+}
+
+func printDryRunPlan(plan *dryRunPlan) {
+	fmt.Printf("\nDry run, nothing is changed. Planned changes:\n")
+	fmt.Printf("    glue address : %s (from nodeCIDR %s)\n", plan.GlueAddr, plan.Config.NodeCIDR)
+
+	last := ""
+	for _, c := range plan.Changes {
+		if c.Component != last {
+			fmt.Printf("[%s]\n", c.Component)
+			last = c.Component
+		}
+		switch c.Action {
+		case planAdd:
+			fmt.Printf("  + %s: %s\n", c.Object, c.Desired)
+		case planDelete:
+			fmt.Printf("  - %s\n", c.Object)
+		case planChange:
+			fmt.Printf("  ~ %s: %s -> %s\n", c.Object, c.Current, c.Desired)
+		case planKeep:
+			fmt.Printf("  = %s: %s, %s\n", c.Object, c.Current, c.Desired)
+		}
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Printf("  (no changes, live state matches)\n")
+	}
+	for _, e := range plan.Errors {
+		fmt.Printf("ERROR: %s\n", e)
+	}
+
+	buf, _ := json.MarshalIndent(plan, "", "  ")
+	fmt.Printf("\n%s\n", buf)
+}
+
+/*
+预演模式，计算glue设备、地址、策略路由、地址转换规则、tc规则、主机参数及子网文件，与当前状态对比后输出，不做任何修改：
+
+	glued -dry-run -stick-cni-master=enp0s8
+*/
+func DryRun() int {
+	ret := 1
+	inGlueNetns(func() error {
+		ret = dryRun()
+		return nil
+	})
+	return ret
+}
+
+func dryRun() int {
+	if err := resolveDryRunConf(); err != nil {
+		fmt.Printf("ERROR: resolve subnet config fail - %v\n", err)
+		return 1
+	}
+	showGlueRunning(&subnetConf)
+	conf := subnetConf
+
+	plan := &dryRunPlan{Config: conf}
+	addr, err := getGlueAddr(conf)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return 1
+	}
+	plan.GlueAddr = addr.IPNet.String()
+
+	planDevice(plan, conf)
+	planRoutes(plan, conf)
+	if items, err := natBackend.Plan(conf); err != nil {
+		plan.fail("nat", err)
+	} else {
+		plan.Changes = append(plan.Changes, items...)
+	}
+	planTc(plan, conf)
+	planSysctls(plan, conf)
+	planSubnetFile(plan, conf)
+	planCNIConf(plan)
+
+	printDryRunPlan(plan)
+	if len(plan.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
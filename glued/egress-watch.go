@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+出口网关使用的namespace、node和pod缓存，由watch事件更新，有变化时触发同步：
+
+	namespace：全部namespace，只保存带有网关annotation的
+	node：全部node，只保存就绪节点的InternalIP
+	pod：本节点上的pod；本节点为某个namespace的生效网关时，另外watch该namespace的全部pod用于SNAT
+
+每个watch先list并替换对应的缓存，再从list返回的resourceVersion开始watch，watch中断后重新list
+*/
+type egressPod struct {
+	Namespace string
+	IP        string
+}
+
+type egressListWatch struct {
+	name  string
+	list  func() (string, error) // 替换缓存，返回resourceVersion
+	watch func(rv string) (watch.Interface, error)
+	event func(watch.Event)
+}
+
+var (
+	egressCacheLock  sync.Mutex
+	egressNamespaces = map[string]*apiv1.Namespace{}
+	egressNodeIPs    = map[string]string{}
+	egressLocalPods  = map[string]egressPod{}
+	egressGwPods     = map[string]map[string]egressPod{} // namespace -> pods
+	egressGwWatches  = map[string]chan struct{}{}
+
+	egressClient  *kubernetes.Clientset
+	egressTrigger = make(chan struct{}, 1)
+)
+
+func triggerEgressSync() {
+	select {
+	case egressTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func (lw egressListWatch) run(stop <-chan struct{}) {
+	for {
+		if err := lw.once(stop); err != nil {
+			fmt.Printf("Egress: %s - %v\n", lw.name, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (lw egressListWatch) once(stop <-chan struct{}) error {
+	rv, err := lw.list()
+	if err != nil {
+		return fmt.Errorf("list fail - %v", err)
+	}
+	triggerEgressSync()
+
+	w, err := lw.watch(rv)
+	if err != nil {
+		return fmt.Errorf("watch fail - %v", err)
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			if event.Type == watch.Error {
+				return fmt.Errorf("watch error - %v", event.Object)
+			}
+			lw.event(event)
+			triggerEgressSync()
+		}
+	}
+}
+
+func setEgressNamespace(ns *apiv1.Namespace, deleted bool) {
+	if _, ok := ns.Annotations[AnnotationEgressGateway]; ok && !deleted {
+		egressNamespaces[ns.Name] = ns
+	} else {
+		delete(egressNamespaces, ns.Name)
+	}
+}
+
+func setEgressNode(node *apiv1.Node, deleted bool) {
+	if ip := nodeReadyIP(node); ip != nil && !deleted {
+		egressNodeIPs[node.Name] = ip.String()
+	} else {
+		delete(egressNodeIPs, node.Name)
+	}
+}
+
+func setEgressPod(pods map[string]egressPod, pod *apiv1.Pod, deleted bool) {
+	if ip := podActiveIP(pod); ip != "" && !deleted {
+		pods[podKey(pod)] = egressPod{Namespace: pod.Namespace, IP: ip}
+	} else {
+		delete(pods, podKey(pod))
+	}
+}
+
+func namespaceListWatch(clientset *kubernetes.Clientset) egressListWatch {
+	return egressListWatch{
+		name: "namespaces",
+		list: func() (string, error) {
+			list, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return "", err
+			}
+			egressCacheLock.Lock()
+			defer egressCacheLock.Unlock()
+			egressNamespaces = map[string]*apiv1.Namespace{}
+			for i := range list.Items {
+				setEgressNamespace(&list.Items[i], false)
+			}
+			return list.ResourceVersion, nil
+		},
+		watch: func(rv string) (watch.Interface, error) {
+			return clientset.CoreV1().Namespaces().Watch(context.TODO(), metav1.ListOptions{ResourceVersion: rv})
+		},
+		event: func(event watch.Event) {
+			if ns, ok := event.Object.(*apiv1.Namespace); ok {
+				egressCacheLock.Lock()
+				setEgressNamespace(ns, event.Type == watch.Deleted)
+				egressCacheLock.Unlock()
+			}
+		},
+	}
+}
+
+func nodeListWatch(clientset *kubernetes.Clientset) egressListWatch {
+	return egressListWatch{
+		name: "nodes",
+		list: func() (string, error) {
+			list, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return "", err
+			}
+			egressCacheLock.Lock()
+			defer egressCacheLock.Unlock()
+			egressNodeIPs = map[string]string{}
+			for i := range list.Items {
+				setEgressNode(&list.Items[i], false)
+			}
+			return list.ResourceVersion, nil
+		},
+		watch: func(rv string) (watch.Interface, error) {
+			return clientset.CoreV1().Nodes().Watch(context.TODO(), metav1.ListOptions{ResourceVersion: rv})
+		},
+		event: func(event watch.Event) {
+			if node, ok := event.Object.(*apiv1.Node); ok {
+				egressCacheLock.Lock()
+				setEgressNode(node, event.Type == watch.Deleted)
+				egressCacheLock.Unlock()
+			}
+		},
+	}
+}
+
+// namespace为空时watch本节点的pod，否则watch该namespace的全部pod
+func podListWatch(clientset *kubernetes.Clientset, namespace string) egressListWatch {
+	opts := metav1.ListOptions{}
+	name := "pods in " + namespace
+	if namespace == "" {
+		opts.FieldSelector = "spec.nodeName=" + getNodeName()
+		name = "local pods"
+	}
+	store := func() map[string]egressPod {
+		if namespace == "" {
+			return egressLocalPods
+		}
+		return egressGwPods[namespace]
+	}
+
+	return egressListWatch{
+		name: name,
+		list: func() (string, error) {
+			list, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), opts)
+			if err != nil {
+				return "", err
+			}
+			pods := map[string]egressPod{}
+			for i := range list.Items {
+				setEgressPod(pods, &list.Items[i], false)
+			}
+
+			egressCacheLock.Lock()
+			defer egressCacheLock.Unlock()
+			if namespace == "" {
+				egressLocalPods = pods
+			} else if _, ok := egressGwWatches[namespace]; ok {
+				egressGwPods[namespace] = pods
+			}
+			return list.ResourceVersion, nil
+		},
+		watch: func(rv string) (watch.Interface, error) {
+			o := opts
+			o.ResourceVersion = rv
+			return clientset.CoreV1().Pods(namespace).Watch(context.TODO(), o)
+		},
+		event: func(event watch.Event) {
+			if pod, ok := event.Object.(*apiv1.Pod); ok {
+				egressCacheLock.Lock()
+				if pods := store(); pods != nil {
+					setEgressPod(pods, pod, event.Type == watch.Deleted)
+				}
+				egressCacheLock.Unlock()
+			}
+		},
+	}
+}
+
+// 本节点为生效网关的namespace需要其全部pod，网关切走后停止watch
+func syncEgressGatewayWatches(namespaces []string) {
+	if egressClient == nil {
+		return
+	}
+	desired := map[string]bool{}
+	for _, ns := range namespaces {
+		desired[ns] = true
+	}
+
+	egressCacheLock.Lock()
+	defer egressCacheLock.Unlock()
+
+	for ns, stop := range egressGwWatches {
+		if !desired[ns] {
+			fmt.Printf("Egress: stop watching pods in %s\n", ns)
+			close(stop)
+			delete(egressGwWatches, ns)
+			delete(egressGwPods, ns)
+		}
+	}
+	for ns := range desired {
+		if _, ok := egressGwWatches[ns]; ok {
+			continue
+		}
+		fmt.Printf("Egress: gateway for %s, watch its pods\n", ns)
+		stop := make(chan struct{})
+		egressGwWatches[ns] = stop
+		go podListWatch(egressClient, ns).run(stop)
+	}
+}
+
+// 出口网关配置的输入，从缓存复制
+type egressSnapshot struct {
+	Namespaces []*apiv1.Namespace
+	NodeIPs    map[string]string
+	LocalPods  []egressPod
+	GwPods     map[string][]egressPod
+}
+
+func getEgressSnapshot() *egressSnapshot {
+	egressCacheLock.Lock()
+	defer egressCacheLock.Unlock()
+
+	s := &egressSnapshot{NodeIPs: map[string]string{}, GwPods: map[string][]egressPod{}}
+	for _, ns := range egressNamespaces {
+		s.Namespaces = append(s.Namespaces, ns)
+	}
+	for n, ip := range egressNodeIPs {
+		s.NodeIPs[n] = ip
+	}
+	for _, p := range egressLocalPods {
+		s.LocalPods = append(s.LocalPods, p)
+	}
+	for ns, pods := range egressGwPods {
+		for _, p := range pods {
+			s.GwPods[ns] = append(s.GwPods[ns], p)
+		}
+	}
+	return s
+}
+
+func WatchEgress(clientset *kubernetes.Clientset) {
+	egressClient = clientset
+	go namespaceListWatch(clientset).run(nil)
+	go nodeListWatch(clientset).run(nil)
+	go podListWatch(clientset, "").run(nil)
+
+	for {
+		select {
+		case <-egressTrigger:
+			// 合并list后的一批事件
+			time.Sleep(egressSyncDelay)
+			select {
+			case <-egressTrigger:
+			default:
+			}
+		case <-time.After(egressResyncInterval):
+		}
+
+		if err := inGlueNetns(SyncEgress); err != nil {
+			fmt.Printf("Egress: sync fail - %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// 网关节点列表，按顺序第一个就绪的节点生效，其余为备节点
+	AnnotationEgressGateway = "glue.io/egress-gateway"
+	// 网关节点上SNAT使用的出口地址，需与master网卡在同一个二层网络
+	AnnotationEgressIP = "glue.io/egress-ip"
+
+	DefaultGlueEgressChainName = "GLUE-EGRESS"
+
+	egressStateFileName = "egress-addrs.json"
+
+	egressRulePriority = 5000
+	egressTableBase    = 5000
+	egressTableNum     = 256
+	// 事件触发同步前等待，合并一批事件
+	egressSyncDelay = 200 * time.Millisecond
+	// 没有事件时按缓存重新同步，修复被改动的路由和地址
+	egressResyncInterval = 30 * time.Second
+)
+
+/*
+出口网关，在namespace上配置：
+
+	kubectl annotate ns partner glue.io/egress-gateway=node-a,node-b glue.io/egress-ip=192.168.56.200
+
+namespace中的pod访问集群外地址时，经网关节点SNAT为出口地址：
+
+	pod所在节点：按源地址走策略路由转发到网关节点，不做SNAT
+		ip rule add from 172.24.0.5/32 lookup 5000 prio 5000
+		ip route add default via 192.168.56.11 dev enp0s8 onlink table 5000
+		ip route add throw 172.24.0.0/21 table 5000 (podCIDR、serviceCIDR及non-masquerade-cidrs)
+		iptables -t nat -A GLUE-EGRESS -s 172.24.0.5/32 -j ACCEPT
+	网关节点：master网卡上添加出口地址，SNAT为出口地址
+		ip addr add 192.168.56.200/32 dev enp0s8
+		iptables -t nat -A GLUE-EGRESS -s 172.24.0.5/32 -j SNAT --to-source 192.168.56.200
+
+网关节点NotReady时切换到下一个节点，新网关添加出口地址后发送免费ARP
+依赖pod默认网关为glue设备，仅支持macvlan
+*/
+type egressPolicy struct {
+	Namespace string
+	Nodes     []string
+	EgressIP  net.IP
+	Gateway   string // 当前生效的网关节点
+	GatewayIP net.IP
+}
+
+// 网关相关的nat规则，SNAT为空时表示不做SNAT，由网关节点处理
+type egressNatRule struct {
+	Src  string
+	SNAT string
+}
+
+var (
+	egressLock        sync.Mutex
+	egressNat         []egressNatRule
+	egressAddrs       = map[string]bool{} // 本节点作为网关时在master上添加的出口地址
+	egressAddrsLoaded bool
+)
+
+// 出口地址记录在状态文件中，glued重启后接管
+func loadEgressAddrs() {
+	if egressAddrsLoaded {
+		return
+	}
+	egressAddrsLoaded = true
+
+	buf, err := ioutil.ReadFile(stateFilePath(egressStateFileName))
+	if err != nil {
+		return
+	}
+	var addrs []string
+	if err := json.Unmarshal(buf, &addrs); err != nil {
+		return
+	}
+	for _, a := range addrs {
+		egressAddrs[a] = true
+	}
+}
+
+func saveEgressAddrs() {
+	addrs := []string{}
+	for a := range egressAddrs {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+
+	path := stateFilePath(egressStateFileName)
+	if len(addrs) == 0 {
+		os.Remove(path)
+		return
+	}
+	buf, _ := json.Marshal(addrs)
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		fmt.Printf("Egress: save %s fail - %v\n", path, err)
+	}
+}
+
+func getEgressNatRules() []egressNatRule {
+	egressLock.Lock()
+	defer egressLock.Unlock()
+	return append([]egressNatRule{}, egressNat...)
+}
+
+func parseEgressPolicy(ns *apiv1.Namespace) (*egressPolicy, error) {
+	gw, ok := ns.Annotations[AnnotationEgressGateway]
+	if !ok {
+		return nil, nil
+	}
+
+	p := &egressPolicy{Namespace: ns.Name}
+	for _, n := range strings.Split(gw, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			p.Nodes = append(p.Nodes, n)
+		}
+	}
+	if len(p.Nodes) == 0 {
+		return nil, fmt.Errorf("no gateway node in %s", AnnotationEgressGateway)
+	}
+
+	p.EgressIP = net.ParseIP(strings.TrimSpace(ns.Annotations[AnnotationEgressIP])).To4()
+	if p.EgressIP == nil {
+		return nil, fmt.Errorf("invalid %s %q", AnnotationEgressIP, ns.Annotations[AnnotationEgressIP])
+	}
+	return p, nil
+}
+
+// 节点就绪时返回其InternalIP
+func nodeReadyIP(node *apiv1.Node) net.IP {
+	ready := false
+	for _, c := range node.Status.Conditions {
+		if c.Type == apiv1.NodeReady && c.Status == apiv1.ConditionTrue {
+			ready = true
+		}
+	}
+	if !ready {
+		return nil
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == apiv1.NodeInternalIP {
+			if ip := net.ParseIP(addr.Address).To4(); ip != nil {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+func podActiveIP(pod *apiv1.Pod) string {
+	if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+		return ""
+	}
+	if pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+		return ""
+	}
+	if net.ParseIP(pod.Status.PodIP).To4() == nil {
+		return ""
+	}
+	return pod.Status.PodIP
+}
+
+// 本节点期望的出口网关配置
+type egressState struct {
+	Rules  []netlink.Rule
+	Routes []netlink.Route
+	Nat    []egressNatRule
+	Addrs  []string
+	// 本节点为生效网关的namespace
+	GatewayNamespaces []string
+}
+
+func buildEgressState(snap *egressSnapshot, conf GlueSubnetConf, master netlink.Link) (*egressState, error) {
+	sort.Slice(snap.Namespaces, func(i, j int) bool { return snap.Namespaces[i].Name < snap.Namespaces[j].Name })
+
+	var policies []*egressPolicy
+	for _, ns := range snap.Namespaces {
+		p, err := parseEgressPolicy(ns)
+		if err != nil {
+			fmt.Printf("Egress: namespace %s - %v\n", ns.Name, err)
+			continue
+		}
+		if p != nil {
+			policies = append(policies, p)
+		}
+	}
+
+	st := &egressState{}
+	if len(policies) == 0 {
+		return st, nil
+	}
+	if conf.Master.Type != "macvlan" {
+		return st, fmt.Errorf("egress gateway only supported with macvlan")
+	}
+
+	// 每个网关节点使用一张路由表
+	tables := map[string]int{}
+	local := getNodeName()
+	for _, p := range policies {
+		for _, n := range p.Nodes {
+			if ip, ok := snap.NodeIPs[n]; ok {
+				p.Gateway, p.GatewayIP = n, net.ParseIP(ip).To4()
+				break
+			}
+		}
+		if p.Gateway == "" {
+			fmt.Printf("Egress: namespace %s has no ready gateway node in %v\n", p.Namespace, p.Nodes)
+			continue
+		}
+		if p.Gateway != local {
+			tables[p.GatewayIP.String()] = 0
+		} else {
+			st.GatewayNamespaces = append(st.GatewayNamespaces, p.Namespace)
+		}
+	}
+	gws := make([]string, 0, len(tables))
+	for gw := range tables {
+		gws = append(gws, gw)
+	}
+	sort.Strings(gws)
+	for i, gw := range gws {
+		tables[gw] = egressTableBase + i
+		st.Routes = append(st.Routes, egressTableRoutes(conf, master, net.ParseIP(gw), tables[gw])...)
+	}
+
+	for _, p := range policies {
+		if p.Gateway == "" {
+			continue
+		}
+		// 网关节点对namespace的全部pod做SNAT
+		if p.Gateway == local {
+			st.Addrs = append(st.Addrs, p.EgressIP.String())
+			for _, pod := range snap.GwPods[p.Namespace] {
+				st.Nat = append(st.Nat, egressNatRule{Src: pod.IP + "/32", SNAT: p.EgressIP.String()})
+			}
+			continue
+		}
+
+		for _, pod := range snap.LocalPods {
+			if pod.Namespace != p.Namespace {
+				continue
+			}
+			st.Nat = append(st.Nat, egressNatRule{Src: pod.IP + "/32"})
+			rule := netlink.NewRule()
+			rule.Priority = egressRulePriority
+			rule.Table = tables[p.GatewayIP.String()]
+			rule.Src = &net.IPNet{IP: net.ParseIP(pod.IP).To4(), Mask: net.CIDRMask(32, 32)}
+			st.Rules = append(st.Rules, *rule)
+		}
+	}
+	return st, nil
+}
+
+func egressTableRoutes(conf GlueSubnetConf, master netlink.Link, gw net.IP, table int) []netlink.Route {
+	// 默认路由Dst为空，与内核返回的一致
+	routes := []netlink.Route{{
+		LinkIndex: master.Attrs().Index,
+		Gw:        gw,
+		Type:      unix.RTN_UNICAST,
+		Flags:     int(netlink.FLAG_ONLINK),
+		Table:     table,
+	}}
+
+	// 集群内地址回到main表查找
+	cidrs := nonMasqCIDRs(conf)
+	if conf.ServiceCIDR != "" {
+		cidrs = append(cidrs, conf.ServiceCIDR)
+	}
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			continue
+		}
+		routes = append(routes, netlink.Route{Dst: ipnet, Type: unix.RTN_THROW, Table: table})
+	}
+	return routes
+}
+
+func isEgressTable(table int) bool {
+	return table >= egressTableBase && table < egressTableBase+egressTableNum
+}
+
+func egressRouteKey(r netlink.Route) string {
+	return fmt.Sprintf("%d/%d/%v/%v", r.Table, r.Type, r.Dst, r.Gw)
+}
+
+func syncEgressRoutes(st *egressState) error {
+	rules, err := netlink.RuleListFiltered(netlink.FAMILY_V4, &netlink.Rule{Priority: egressRulePriority}, netlink.RT_FILTER_PRIORITY)
+	if err != nil {
+		return fmt.Errorf("list rules fail - %v", err)
+	}
+	desiredRules := map[string]bool{}
+	for _, r := range st.Rules {
+		desiredRules[r.String()] = true
+	}
+	for i := range rules {
+		// 同优先级上其他程序的规则不处理
+		if !isEgressTable(rules[i].Table) {
+			continue
+		}
+		if !desiredRules[rules[i].String()] {
+			netlink.RuleDel(&rules[i])
+		}
+		delete(desiredRules, rules[i].String())
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("list routes fail - %v", err)
+	}
+	desiredRoutes := map[string]bool{}
+	for _, r := range st.Routes {
+		desiredRoutes[egressRouteKey(r)] = true
+	}
+	current := map[string]bool{}
+	for i := range routes {
+		if !isEgressTable(routes[i].Table) {
+			continue
+		}
+		key := egressRouteKey(routes[i])
+		if !desiredRoutes[key] {
+			netlink.RouteDel(&routes[i])
+		}
+		current[key] = true
+	}
+
+	for i := range st.Routes {
+		if current[egressRouteKey(st.Routes[i])] {
+			continue
+		}
+		if err := netlink.RouteReplace(&st.Routes[i]); err != nil {
+			return fmt.Errorf("add egress route %v fail - %v", st.Routes[i], err)
+		}
+	}
+	for i := range st.Rules {
+		if !desiredRules[st.Rules[i].String()] {
+			continue
+		}
+		if err := netlink.RuleAdd(&st.Rules[i]); err != nil {
+			return fmt.Errorf("add egress rule %v fail - %v", st.Rules[i], err)
+		}
+	}
+	return nil
+}
+
+func syncEgressAddrs(master netlink.Link, addrs []string) error {
+	desired := map[string]bool{}
+	for _, a := range addrs {
+		desired[a] = true
+	}
+
+	egressLock.Lock()
+	defer egressLock.Unlock()
+
+	loadEgressAddrs()
+	defer saveEgressAddrs()
+
+	for a := range egressAddrs {
+		if desired[a] {
+			continue
+		}
+		fmt.Printf("Egress: remove egress ip %s from %s\n", a, master.Attrs().Name)
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(a), Mask: net.CIDRMask(32, 32)}}
+		netlink.AddrDel(master, addr)
+		delete(egressAddrs, a)
+	}
+
+	for a := range desired {
+		if egressAddrs[a] {
+			continue
+		}
+		fmt.Printf("Egress: take over egress ip %s on %s\n", a, master.Attrs().Name)
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(a), Mask: net.CIDRMask(32, 32)}}
+		if err := netlink.AddrReplace(master, addr); err != nil {
+			return fmt.Errorf("add egress ip %s fail - %v", a, err)
+		}
+		egressAddrs[a] = true
+		if err := sendGratuitousARP(master, net.ParseIP(a)); err != nil {
+			fmt.Printf("Egress: send gratuitous arp for %s fail - %v\n", a, err)
+		}
+	}
+	return nil
+}
+
+// 网关切换后通告出口地址的新位置
+func sendGratuitousARP(link netlink.Link, ip net.IP) error {
+	mac := link.Attrs().HardwareAddr
+	ip4 := ip.To4()
+	if len(mac) != 6 || ip4 == nil {
+		return fmt.Errorf("invalid mac %v or ip %v", mac, ip)
+	}
+
+	frame := make([]byte, 0, 42)
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06)
+	arp := make([]byte, 8)
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // ipv4
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], 1) // request
+	frame = append(frame, arp...)
+	frame = append(frame, mac...)
+	frame = append(frame, ip4...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip4...)
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  link.Attrs().Index,
+		Halen:    6,
+	}
+	copy(sa.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return unix.Sendto(fd, frame, 0, sa)
+}
+
+func egressNatEqual(a, b []egressNatRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func SyncEgress() error {
+	dataPlaneLock.Lock()
+	defer dataPlaneLock.Unlock()
+
+	conf := subnetConf
+	if conf.NodeCIDR == "" || natBackend == nil {
+		return nil
+	}
+	master, err := netlink.LinkByName(conf.Master.Master)
+	if err != nil {
+		return err
+	}
+
+	// ipvlan等不支持的场景返回空配置及错误，清理已有配置
+	st, buildErr := buildEgressState(getEgressSnapshot(), conf, master)
+	syncEgressGatewayWatches(st.GatewayNamespaces)
+
+	sort.Slice(st.Nat, func(i, j int) bool { return st.Nat[i].Src < st.Nat[j].Src })
+	egressLock.Lock()
+	oldNat := egressNat
+	natChanged := !egressNatEqual(oldNat, st.Nat)
+	egressNat = st.Nat
+	egressLock.Unlock()
+
+	// 先更新nat规则再切换路由，nat后端按egressNat生成规则，同步失败时恢复原值，下次重试
+	if natChanged {
+		fmt.Printf("Egress: %d nat rules\n", len(st.Nat))
+		if _, err := natBackend.Sync(conf); err != nil {
+			egressLock.Lock()
+			egressNat = oldNat
+			egressLock.Unlock()
+			return err
+		}
+	}
+	if err := syncEgressAddrs(master, st.Addrs); err != nil {
+		return err
+	}
+	if err := syncEgressRoutes(st); err != nil {
+		return err
+	}
+	return buildErr
+}
+
+func CleanEgress() {
+	st := &egressState{}
+	syncEgressRoutes(st)
+
+	if master, err := netlink.LinkByName(subnetConf.Master.Master); err == nil {
+		syncEgressAddrs(master, nil)
+	}
+
+	egressLock.Lock()
+	egressNat = nil
+	egressLock.Unlock()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// watch中断超过该时间认为glued不再存活
+	watchDeadTimeout = 2 * time.Minute
+)
+
+var (
+	watchLock      sync.Mutex
+	watchRequired  bool      // 使用kubernetes配置时需要watch
+	watchLive      bool      // node watch是否正常
+	watchDownSince time.Time // node watch中断的时间
+)
+
+func SetWatchLive(live bool) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
+	watchRequired = true
+	if watchLive && !live {
+		watchDownSince = time.Now()
+	}
+	watchLive = live
+}
+
+func checkWatch() error {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
+	if watchRequired && !watchLive {
+		return fmt.Errorf("node watch is down since %v", watchDownSince.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func checkGlueDevice() error {
+	if subnetConf.NodeCIDR == "" {
+		return fmt.Errorf("node CIDR not allocated yet")
+	}
+
+	link, err := netlink.LinkByName(DefaltGlueDeviceName)
+	if err != nil {
+		return fmt.Errorf("glue device not found")
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("glue device is down")
+	}
+
+	expected, err := getGlueAddr(subnetConf)
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IPNet.String() == expected.IPNet.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("glue device has no address %s", expected.IPNet.String())
+}
+
+func checkTcConfig() error {
+	if subnetConf.Master.Type != "ipvlan" {
+		return nil
+	}
+	exists, err := IpvlanTcConfigExists(subnetConf)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ipvlan service redirect filter not found on %s", subnetConf.Master.Master)
+	}
+	return nil
+}
+
+func checkSubnetFile() error {
+	exists, err := FileExists(*argSubnetFile)
+	if err != nil {
+		return err
+	}
+	if !exists || subnetFileWriteTime.IsZero() {
+		return fmt.Errorf("subnet file %s not written", *argSubnetFile)
+	}
+	return nil
+}
+
+type healthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// 数据面检查，决定是否写入CNI配置
+var dataPlaneChecks = []healthCheck{
+	{"device", checkGlueDevice},
+	{"nat", CheckNat},
+	{"tc", checkTcConfig},
+	{"subnet-file", checkSubnetFile},
+}
+
+var readyChecks = append(append([]healthCheck{}, dataPlaneChecks...),
+	healthCheck{"install", checkInstalledFiles},
+	healthCheck{"watch", checkWatch},
+)
+
+// 执行全部检查，返回是否全部通过及检查结果
+func runChecks(checks []healthCheck) (bool, string) {
+	ok := true
+	buf := &bytes.Buffer{}
+	for _, c := range checks {
+		if err := c.Check(); err != nil {
+			ok = false
+			fmt.Fprintf(buf, "[-]%s failed: %v\n", c.Name, err)
+		} else {
+			fmt.Fprintf(buf, "[+]%s ok\n", c.Name)
+		}
+	}
+	return ok, buf.String()
+}
+
+// 数据面已就绪
+func IsReady() bool {
+	ok, _ := runChecks(readyChecks)
+	return ok
+}
+
+func writeCheckResult(w http.ResponseWriter, ok bool, detail string) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, detail)
+}
+
+// 存活检查：node watch中断时间过长时失败，由kubelet重启glued
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	watchLock.Lock()
+	dead := watchRequired && !watchLive && time.Since(watchDownSince) > watchDeadTimeout
+	watchLock.Unlock()
+
+	if dead {
+		writeCheckResult(w, false, "[-]watch failed: node watch is down too long\n")
+		return
+	}
+	writeCheckResult(w, true, "ok\n")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ok, detail := runChecks(readyChecks)
+	writeCheckResult(w, ok, detail)
+}
+
+func init() {
+	RegisterAPI("/healthz", healthzHandler)
+	RegisterAPI("/readyz", readyzHandler)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	hostSnapshotFileName = "host-snapshot.json"
+)
+
+/*
+glued管理的主机内核参数及网卡标志，首次修改前记录原始值，卸载时恢复：
+
+	net.ipv4.ip_forward = 1
+	net.ipv4.conf.<master|glue>.rp_filter = 2        回包可能从另一个网卡进入，使用宽松模式
+	net.ipv4.conf.<master|glue>.arp_ignore = 1       同一二层中有多个网卡，只应答本网卡地址的ARP
+	net.ipv4.conf.<master|glue>.arp_announce = 2
+	net.ipv4.conf.glue.promote_secondaries = 1
+	net.ipv4.neigh.default.gc_thresh1/2/3 >= 1024/4096/8192   大二层中邻居表项较多
+	ip link set <master> promisc on                  macvlan子接口使用不同的MAC
+
+非特权容器中/proc/sys为只读，内核参数写入失败只输出告警，不影响启动和就绪状态
+*/
+type sysctlSetting struct {
+	Key   string // 相对 /proc/sys 的路径
+	Value int
+	Min   bool // 当前值不小于Value时不修改
+	Owned bool // glue设备的参数随设备删除，不需要恢复
+}
+
+type hostSnapshot struct {
+	Sysctls map[string]string `json:"sysctls"`
+	Promisc map[string]bool   `json:"promisc"`
+}
+
+var (
+	hostSnapshotLock sync.Mutex
+	sysctlWarned     = map[string]string{} // 已告警的写入失败，相同的错误只输出一次
+)
+
+func desiredSysctls(conf GlueSubnetConf) []sysctlSetting {
+	settings := []sysctlSetting{
+		{Key: "net/ipv4/ip_forward", Value: 1},
+		{Key: "net/ipv4/neigh/default/gc_thresh1", Value: 1024, Min: true},
+		{Key: "net/ipv4/neigh/default/gc_thresh2", Value: 4096, Min: true},
+		{Key: "net/ipv4/neigh/default/gc_thresh3", Value: 8192, Min: true},
+	}
+
+	devs := []struct {
+		name  string
+		owned bool
+	}{{conf.Master.Master, false}, {DefaltGlueDeviceName, true}}
+	for _, dev := range devs {
+		if dev.name == "" {
+			continue
+		}
+		settings = append(settings,
+			sysctlSetting{Key: "net/ipv4/conf/" + dev.name + "/rp_filter", Value: 2, Owned: dev.owned},
+			sysctlSetting{Key: "net/ipv4/conf/" + dev.name + "/arp_ignore", Value: 1, Owned: dev.owned},
+			sysctlSetting{Key: "net/ipv4/conf/" + dev.name + "/arp_announce", Value: 2, Owned: dev.owned},
+		)
+	}
+	// glue设备更新地址时保留旧地址，删除主地址后提升从地址
+	settings = append(settings, sysctlSetting{Key: "net/ipv4/conf/" + DefaltGlueDeviceName + "/promote_secondaries", Value: 1, Owned: true})
+	return settings
+}
+
+func hostSnapshotFile() string {
+	return stateFilePath(hostSnapshotFileName)
+}
+
+func loadHostSnapshot() *hostSnapshot {
+	snap := &hostSnapshot{Sysctls: map[string]string{}, Promisc: map[string]bool{}}
+	buf, err := ioutil.ReadFile(hostSnapshotFile())
+	if err != nil {
+		return snap
+	}
+	if err := json.Unmarshal(buf, snap); err != nil {
+		fmt.Printf("HostSettings: parse %s fail - %v\n", hostSnapshotFile(), err)
+	}
+	if snap.Sysctls == nil {
+		snap.Sysctls = map[string]string{}
+	}
+	if snap.Promisc == nil {
+		snap.Promisc = map[string]bool{}
+	}
+	return snap
+}
+
+func saveHostSnapshot(snap *hostSnapshot) error {
+	if err := os.MkdirAll(filepath.Dir(hostSnapshotFile()), 0700); err != nil {
+		return err
+	}
+	buf, _ := json.Marshal(snap)
+	return ioutil.WriteFile(hostSnapshotFile(), buf, 0600)
+}
+
+func readSysctl(key string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join("/proc/sys", key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func writeSysctl(key, value string) error {
+	return ioutil.WriteFile(filepath.Join("/proc/sys", key), []byte(value), 0644)
+}
+
+func sysctlSatisfied(s sysctlSetting, cur string) bool {
+	v, err := strconv.Atoi(cur)
+	if err != nil {
+		return false
+	}
+	if s.Min {
+		return v >= s.Value
+	}
+	return v == s.Value
+}
+
+// 修改前记录原始值，已记录的不覆盖
+func recordSysctl(snap *hostSnapshot, s sysctlSetting, cur string) bool {
+	if s.Owned {
+		return false
+	}
+	if _, ok := snap.Sysctls[s.Key]; ok {
+		return false
+	}
+	snap.Sysctls[s.Key] = cur
+	return true
+}
+
+func recordPromisc(snap *hostSnapshot, link netlink.Link) bool {
+	if _, ok := snap.Promisc[link.Attrs().Name]; ok {
+		return false
+	}
+	snap.Promisc[link.Attrs().Name] = link.Attrs().Promisc != 0
+	return true
+}
+
+// 设置父接口为混杂模式
+func ensurePromisc(link netlink.Link) (bool, error) {
+	if link.Attrs().Promisc != 0 {
+		return false, nil
+	}
+
+	hostSnapshotLock.Lock()
+	defer hostSnapshotLock.Unlock()
+
+	snap := loadHostSnapshot()
+	if recordPromisc(snap, link) {
+		if err := saveHostSnapshot(snap); err != nil {
+			return false, fmt.Errorf("save host snapshot fail - %v", err)
+		}
+	}
+	if err := netlink.SetPromiscOn(link); err != nil {
+		return false, fmt.Errorf("set %s promisc on fail - %v", link.Attrs().Name, err)
+	}
+	return true, nil
+}
+
+/*
+按声明设置主机参数，fixed用于输出被修改的项
+设备不存在时跳过该设备的参数
+*/
+func ApplyHostSettings(conf GlueSubnetConf, fixed func(format string, args ...interface{})) error {
+	var errs []string
+
+	hostSnapshotLock.Lock()
+	snap := loadHostSnapshot()
+	changed := false
+	for _, s := range desiredSysctls(conf) {
+		cur, err := readSysctl(s.Key)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Sprintf("%s: %v", s.Key, err))
+			}
+			continue
+		}
+		if sysctlSatisfied(s, cur) {
+			continue
+		}
+
+		if recordSysctl(snap, s, cur) {
+			changed = true
+		}
+		if err := writeSysctl(s.Key, strconv.Itoa(s.Value)); err != nil {
+			if sysctlWarned[s.Key] != err.Error() {
+				sysctlWarned[s.Key] = err.Error()
+				fmt.Printf("HostSettings: WARNING set %s = %d fail, current %s - %v\n", strings.ReplaceAll(s.Key, "/", "."), s.Value, cur, err)
+			}
+			continue
+		}
+		delete(sysctlWarned, s.Key)
+		fixed("set %s %s -> %d", strings.ReplaceAll(s.Key, "/", "."), cur, s.Value)
+	}
+	if changed {
+		if err := saveHostSnapshot(snap); err != nil {
+			errs = append(errs, fmt.Sprintf("save host snapshot: %v", err))
+		}
+	}
+	hostSnapshotLock.Unlock()
+
+	if conf.Master.Type == "macvlan" && conf.Master.Master != "" {
+		if master, err := netlink.LinkByName(conf.Master.Master); err == nil {
+			if set, err := ensurePromisc(master); err != nil {
+				errs = append(errs, err.Error())
+			} else if set {
+				fixed("set %s promisc on", conf.Master.Master)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("apply host settings fail - %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// 恢复记录的原始值
+func RestoreHostSettings() {
+	hostSnapshotLock.Lock()
+	defer hostSnapshotLock.Unlock()
+
+	snap := loadHostSnapshot()
+	for key, value := range snap.Sysctls {
+		fmt.Printf("HostSettings: restore %s = %s\n", strings.ReplaceAll(key, "/", "."), value)
+		if err := writeSysctl(key, value); err != nil {
+			fmt.Printf("HostSettings: restore %s fail - %v\n", key, err)
+		}
+	}
+	for name, promisc := range snap.Promisc {
+		if promisc {
+			continue
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("HostSettings: restore %s promisc off\n", name)
+		netlink.SetPromiscOff(link)
+	}
+	os.Remove(hostSnapshotFile())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 构建时通过 -ldflags "-X main.glueVersion=..." 指定，与glue插件使用同一个版本
+var glueVersion = "v0.1"
+
+/*
+安装GLUE_FILES_TO_COPY_ON_BOOT中指定的文件（glue插件和CNI配置）：
+
+	GLUE_FILES_TO_COPY_ON_BOOT=/bin/glue:/opt/cni/bin/glue,/etc/glue/cni-conf.json:/etc/cni/net.d/10-glue.conflist
+
+先写入同目录下的临时文件，校验内容后rename覆盖目标文件，kubelet正在执行的旧插件不受影响，也不会读到写了一半的文件。
+内容相同时不重写。安装的文件及其sha256和glued版本记录在子网文件中，glue插件据此检查版本是否一致
+*/
+func fileChecksum(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func installFile(src, dst string) (string, error) {
+	input, err := ioutil.ReadFile(src)
+	if err != nil {
+		return "", fmt.Errorf("read file %v err - %v", src, err)
+	}
+	// 可执行文件（插件）保持可执行，配置文件只读
+	mode := os.FileMode(0644)
+	if st, err := os.Stat(src); err == nil && st.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	sum := sha256.Sum256(input)
+	checksum := hex.EncodeToString(sum[:])
+
+	if cur, err := fileChecksum(dst); err == nil && cur == checksum {
+		fmt.Printf("install %v: up to date (sha256 %s)\n", dst, checksum[:12])
+		return checksum, nil
+	}
+
+	if err := writeFileAtomic(dst, input, mode); err != nil {
+		return "", err
+	}
+	fmt.Printf("install %v to %v (sha256 %s)\n", src, dst, checksum[:12])
+	return checksum, nil
+}
+
+// 写入同目录下的临时文件，校验内容后rename覆盖目标文件
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("create temp file in %v err - %v", dir, err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write file %v err - %v", tmpName, err)
+	}
+
+	if got, err := fileChecksum(tmpName); err != nil || got != checksum {
+		return fmt.Errorf("checksum of %v mismatch, want %s got %s(%v)", tmpName, checksum, got, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("rename %v to %v err - %v", tmpName, path, err)
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// 解析GLUE_FILES_TO_COPY_ON_BOOT，返回 源文件:目标文件 列表
+func bootFiles() [][2]string {
+	env := os.Getenv("GLUE_FILES_TO_COPY_ON_BOOT")
+	if env == "" {
+		return nil
+	}
+
+	var files [][2]string
+	filesToRCopy := strings.Split(env, ",")
+	for _, pair := range filesToRCopy {
+		kv := strings.Split(pair, ":")
+		if len(kv) != 2 {
+			fmt.Printf("Invalid args in env GLUE_FILES_TO_COPY_ON_BOOT, arg = %s, skip\n", filesToRCopy)
+			continue
+		}
+		files = append(files, [2]string{kv[0], kv[1]})
+	}
+	return files
+}
+
+func InstallBootFiles() {
+	files := bootFiles()
+	if len(files) == 0 {
+		return
+	}
+
+	fmt.Printf("Install files on boot...\n")
+	installed := map[string]string{}
+	for _, f := range files {
+		checksum, err := installFile(f[0], f[1])
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			continue
+		}
+		installed[f[1]] = checksum
+	}
+	subnetConf.Installed = installed
+}
+
+// 安装的文件被其他版本的glued替换或被修改时，插件与glued的版本可能不一致
+func checkInstalledFiles() error {
+	var skew []string
+	for path, want := range subnetConf.Installed {
+		got, err := fileChecksum(path)
+		if err != nil {
+			skew = append(skew, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if got != want {
+			skew = append(skew, fmt.Sprintf("%s: sha256 %s, installed %s", path, got[:12], want[:12]))
+		}
+	}
+	if len(skew) > 0 {
+		return fmt.Errorf("installed files changed, version skew with glued %s - %s", glueVersion, strings.Join(skew, "; "))
+	}
+	return nil
+}
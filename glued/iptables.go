@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	kubeMarkMasqChain = "KUBE-MARK-MASQ"
+)
+
+// iptables后端，在nat表中维护GLUE-PREROUTING/GLUE-POSTROUTING链
+type iptablesBackend struct{}
+
+func (b *iptablesBackend) Name() string {
+	return NatBackendIptables
+}
+
+func (b *iptablesBackend) Sync(conf GlueSubnetConf) (bool, error) {
+	return SyncIptables(conf)
+}
+
+func (b *iptablesBackend) Check(conf GlueSubnetConf) error {
+	return CheckIptables(conf)
+}
+
+func (b *iptablesBackend) Plan(conf GlueSubnetConf) ([]planItem, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := diffIptables(ipt, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []planItem
+	for _, d := range diffs {
+		if !d.ChainExists {
+			items = append(items, planItem{Component: "iptables", Action: planAdd, Object: "nat " + d.Chain, Desired: "-N " + d.Chain})
+		}
+		if d.RulesChanged() {
+			for _, r := range d.Current {
+				if !StringInArr(d.Desired, r) {
+					items = append(items, planItem{Component: "iptables", Action: planDelete, Object: r, Current: r})
+				}
+			}
+			for _, r := range d.Desired {
+				if !StringInArr(d.Current, r) {
+					items = append(items, planItem{Component: "iptables", Action: planAdd, Object: r, Desired: r})
+				}
+			}
+		}
+		if d.JumpMissing {
+			r := fmt.Sprintf("-I %s 1 -j %s", d.JumpFrom, d.Chain)
+			items = append(items, planItem{Component: "iptables", Action: planAdd, Object: r, Desired: r})
+		}
+	}
+	return items, nil
+}
+
+func (b *iptablesBackend) Clean() error {
+	return CleanIptables()
+}
+
+// 期望的nat表规则，按链分组，格式与 iptables -S 的输出一致
+type iptablesRuleSet struct {
+	Chain string
+	Rules [][]string
+	// 在父链中插入的跳转规则，为空时由其他glue链跳转
+	JumpFrom string
+}
+
+// iptables -S 输出的是网络地址加掩码，如172.24.0.5/24输出为172.24.0.0/24，单个地址输出为/32
+func canonicalCIDR(s string) string {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet.String()
+	}
+	if ip := net.ParseIP(s).To4(); ip != nil {
+		return ip.String() + "/32"
+	}
+	return s
+}
+
+/*
+-A GLUE-PREROUTING -s 172.24.0.0/24 -d 172.23.0.0/24 -i glue -j MARK --set-xmark 0x1000/0x1000
+-A GLUE-POSTROUTING -m mark --mark 0x1000/0x1000 -j MASQUERADE
+-A GLUE-POSTROUTING -j GLUE-EGRESS
+-A GLUE-POSTROUTING ! -s 172.24.0.0/24 -j RETURN
+-A GLUE-POSTROUTING -d 172.24.0.0/21 -j RETURN
+-A GLUE-POSTROUTING -d 10.0.0.0/8 -j RETURN
+...
+-A GLUE-POSTROUTING -j MASQUERADE
+*/
+func desiredIptablesRules(conf GlueSubnetConf) []iptablesRuleSet {
+	mark := fmt.Sprintf("0x%x/0x%x", glueMasqMark, glueMasqMark)
+	nodeCIDR, serviceCIDR := canonicalCIDR(conf.NodeCIDR), canonicalCIDR(conf.ServiceCIDR)
+
+	post := [][]string{
+		{"-m", "mark", "--mark", mark, "-j", "MASQUERADE"},
+		{"-j", DefaultGlueEgressChainName},
+	}
+	if *argMasqEgress {
+		post = append(post, []string{"!", "-s", nodeCIDR, "-j", "RETURN"})
+		for _, cidr := range nonMasqCIDRs(conf) {
+			post = append(post, []string{"-d", cidr, "-j", "RETURN"})
+		}
+		post = append(post, []string{"-j", "MASQUERADE"})
+	}
+
+	// 出口网关规则，跳过集群内地址
+	var egress [][]string
+	if rules := getEgressNatRules(); len(rules) > 0 {
+		for _, cidr := range nonMasqCIDRs(conf) {
+			egress = append(egress, []string{"-d", cidr, "-j", "RETURN"})
+		}
+		for _, r := range rules {
+			src := canonicalCIDR(r.Src)
+			if r.SNAT == "" {
+				egress = append(egress, []string{"-s", src, "-j", "ACCEPT"})
+			} else {
+				egress = append(egress, []string{"-s", src, "-j", "SNAT", "--to-source", r.SNAT})
+			}
+		}
+	}
+
+	return []iptablesRuleSet{
+		{
+			Chain: DefaultGlueEgressChainName,
+			Rules: egress,
+		},
+		{
+			Chain: DefaultGluePREChainName,
+			Rules: [][]string{
+				{"-s", nodeCIDR, "-d", serviceCIDR, "-i", DefaltGlueDeviceName, "-j", "MARK", "--set-xmark", mark},
+			},
+			JumpFrom: "PREROUTING",
+		},
+		{
+			Chain:    DefaultGluePOSTChainName,
+			Rules:    post,
+			JumpFrom: "POSTROUTING",
+		},
+	}
+}
+
+type iptablesDiff struct {
+	Chain       string
+	ChainExists bool
+	Current     []string
+	Desired     []string
+	JumpFrom    string
+	JumpMissing bool
+}
+
+func (d iptablesDiff) RulesChanged() bool {
+	if !d.ChainExists || len(d.Current) != len(d.Desired) {
+		return true
+	}
+	for i := range d.Current {
+		if d.Current[i] != d.Desired[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func (d iptablesDiff) Changed() bool {
+	return d.RulesChanged() || d.JumpMissing
+}
+
+// 对比期望规则与当前规则
+func diffIptables(ipt *iptables.IPTables, conf GlueSubnetConf) ([]iptablesDiff, error) {
+	var diffs []iptablesDiff
+	for _, set := range desiredIptablesRules(conf) {
+		d := iptablesDiff{Chain: set.Chain, JumpFrom: set.JumpFrom}
+		for _, rule := range set.Rules {
+			d.Desired = append(d.Desired, "-A "+set.Chain+" "+strings.Join(rule, " "))
+		}
+
+		exists, err := ipt.ChainExists("nat", set.Chain)
+		if err != nil {
+			return nil, err
+		}
+		d.ChainExists = exists
+		if exists {
+			lines, err := ipt.List("nat", set.Chain)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lines {
+				if strings.HasPrefix(line, "-A ") {
+					d.Current = append(d.Current, line)
+				}
+			}
+		}
+
+		if set.JumpFrom != "" {
+			exists, err := ipt.Exists("nat", set.JumpFrom, "-j", set.Chain)
+			if err != nil {
+				return nil, err
+			}
+			d.JumpMissing = !exists
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+/*
+生成 iptables-restore 的输入，声明的链在 --noflush 模式下会被清空后重建：
+*nat
+:GLUE-PREROUTING - [0:0]
+-A GLUE-PREROUTING -s 172.24.0.0/24 -d 172.23.0.0/24 -i glue -j MARK --set-xmark 0x1000/0x1000
+-I PREROUTING 1 -j GLUE-PREROUTING
+COMMIT
+*/
+func buildIptablesRestore(diffs []iptablesDiff) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("*nat\n")
+	for _, d := range diffs {
+		if d.RulesChanged() {
+			fmt.Fprintf(buf, ":%s - [0:0]\n", d.Chain)
+		}
+	}
+	for _, d := range diffs {
+		if !d.RulesChanged() {
+			continue
+		}
+		for _, rule := range d.Desired {
+			buf.WriteString(rule + "\n")
+		}
+	}
+	for _, d := range diffs {
+		if d.JumpMissing {
+			fmt.Fprintf(buf, "-I %s 1 -j %s\n", d.JumpFrom, d.Chain)
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func iptablesRestore(ipt *iptables.IPTables, data []byte) error {
+	path, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		return fmt.Errorf("iptables-restore not found - %v", err)
+	}
+
+	args := []string{"--noflush"}
+	// iptables 1.6.2 之后 iptables-restore 支持等待xtables锁
+	if v1, v2, v3 := ipt.GetIptablesVersion(); v1 > 1 || (v1 == 1 && (v2 > 6 || (v2 == 6 && v3 >= 2))) {
+		args = append(args, "-w")
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables-restore fail - %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// kube-proxy工作在iptables/ipvs模式
+func kubeMarkMasqExists() bool {
+	ipt, err := iptables.New()
+	if err != nil {
+		return false
+	}
+	exists, err := ipt.ChainExists("nat", kubeMarkMasqChain)
+	return err == nil && exists
+}
+
+/*
+声明式同步glue的iptables规则：计算期望规则，与当前规则对比，有差异时通过iptables-restore原子更新
+返回是否有修改
+*/
+func SyncIptables(conf GlueSubnetConf) (bool, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return false, fmt.Errorf("Get iptables handler fail - %v", err)
+	}
+
+	diffs, err := diffIptables(ipt, conf)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, d := range diffs {
+		if d.Changed() {
+			changed = true
+			fmt.Printf("iptables chain %s: current %q, desired %q, jump missing %v\n", d.Chain, d.Current, d.Desired, d.JumpMissing)
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	return true, iptablesRestore(ipt, buildIptablesRestore(diffs))
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	labNodePrefix  = "glue-lab-"
+	labBridge      = "glue-lab0"
+	labHostVethPfx = "gluelab"
+	labMasterName  = "eth0"
+	labConfDir     = "/run/glue/lab"
+	labAPIPortBase = 9750
+)
+
+/*
+单机多节点实验环境，不需要集群和交换机：
+
+	glued lab -nodes 2 -type macvlan
+	cd script/test && NETCONFPATH=/run/glue/lab/glue-lab-1 CNI_PATH=/opt/cni/bin ./priv-net-run.sh ping 10.244.1.1
+
+每个节点一个网络命名空间（glue-lab-1、glue-lab-2...），master网卡eth0为veth，主机端（gluelab1...）接入网桥glue-lab0，
+网桥相当于二层交换机，地址为实验网段的最后一个地址；dummy类型的master不互通，只用于单节点。
+每个节点运行一个 glued -netns 实例，nodeCIDR从podCIDR中依次划分，api地址为 127.0.0.1:9751、9752...
+每个节点的CNI配置写入 /run/glue/lab/<节点>/10-glue.conf，测试pod使用真实的glue插件接入。
+退出时清理全部节点，异常退出后使用 glued lab -down 清理
+*/
+type labConfig struct {
+	Nodes       int
+	PodCIDR     string
+	ServiceCIDR string
+	NodeMask    int
+	LabCIDR     string
+	Type        string
+	Mode        string
+	MasterType  string
+}
+
+type labNode struct {
+	Name     string
+	NodeCIDR string
+	MasterIP *net.IPNet
+	HostVeth string
+}
+
+func labNodeName(i int) string {
+	return labNodePrefix + strconv.Itoa(i)
+}
+
+// 在 /var/run/netns 下创建命名的网络命名空间，与 ip netns add 相同
+func createNamedNetns(name string) error {
+	path := netnsPath(name)
+	if err := os.MkdirAll(namedNetnsDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("create netns file %s fail - %v", path, err)
+	}
+	f.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// 线程切换了命名空间，不解锁，goroutine退出时线程随之退出
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("unshare netns fail - %v", err)
+			return
+		}
+		src := fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+		if err := unix.Mount(src, path, "none", unix.MS_BIND, ""); err != nil {
+			errCh <- fmt.Errorf("bind mount netns %s fail - %v", path, err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	if err := <-errCh; err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func deleteNamedNetns(name string) error {
+	path := netnsPath(name)
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !os.IsNotExist(err) && err != unix.EINVAL {
+		return fmt.Errorf("umount netns %s fail - %v", path, err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func inNamedNetns(name string, f func() error) error {
+	netns, err := ns.GetNS(netnsPath(name))
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+	return netns.Do(func(_ ns.NetNS) error {
+		return f()
+	})
+}
+
+// 按节点序号从podCIDR中划分nodeCIDR，与kube-controller-manager的分配方式一致
+func planLabNodes(lc *labConfig) ([]labNode, *net.IPNet, error) {
+	_, podNet, err := net.ParseCIDR(lc.PodCIDR)
+	if err != nil || podNet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid pod-cidr %q", lc.PodCIDR)
+	}
+	podOnes, _ := podNet.Mask.Size()
+	if lc.NodeMask <= podOnes || lc.NodeMask > 30 {
+		return nil, nil, fmt.Errorf("node-mask %d must be in (%d, 30]", lc.NodeMask, podOnes)
+	}
+	if lc.Nodes <= 0 || lc.Nodes > 1<<uint(lc.NodeMask-podOnes) || lc.Nodes > 200 {
+		return nil, nil, fmt.Errorf("invalid nodes %d", lc.Nodes)
+	}
+
+	_, labNet, err := net.ParseCIDR(lc.LabCIDR)
+	if err != nil || labNet.IP.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid lab-cidr %q", lc.LabCIDR)
+	}
+	labOnes, _ := labNet.Mask.Size()
+	if lc.Nodes+2 > 1<<uint(32-labOnes) {
+		return nil, nil, fmt.Errorf("lab-cidr %s too small for %d nodes", lc.LabCIDR, lc.Nodes)
+	}
+
+	base := Ipv4ToUint32(podNet.IP.To4())
+	labBase := Ipv4ToUint32(labNet.IP.To4())
+	var nodes []labNode
+	for i := 1; i <= lc.Nodes; i++ {
+		nodeNet := &net.IPNet{
+			IP:   Uint32ToIpv4(base + uint32(i-1)<<uint(32-lc.NodeMask)),
+			Mask: net.CIDRMask(lc.NodeMask, 32),
+		}
+		nodes = append(nodes, labNode{
+			Name:     labNodeName(i),
+			NodeCIDR: nodeNet.String(),
+			MasterIP: &net.IPNet{IP: Uint32ToIpv4(labBase + uint32(i)), Mask: labNet.Mask},
+			HostVeth: labHostVethPfx + strconv.Itoa(i),
+		})
+	}
+
+	// 网桥使用实验网段的最后一个地址，作为节点的默认网关
+	gw := &net.IPNet{IP: Uint32ToIpv4(labBase + uint32(1<<uint(32-labOnes)) - 2), Mask: labNet.Mask}
+	return nodes, gw, nil
+}
+
+func setupLabBridge(gw *net.IPNet) (netlink.Link, error) {
+	br, err := netlink.LinkByName(labBridge)
+	if err != nil {
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: labBridge}}); err != nil {
+			return nil, fmt.Errorf("create bridge %s fail - %v", labBridge, err)
+		}
+		if br, err = netlink.LinkByName(labBridge); err != nil {
+			return nil, err
+		}
+	}
+	if err := netlink.AddrReplace(br, &netlink.Addr{IPNet: gw}); err != nil {
+		return nil, fmt.Errorf("add address %s to %s fail - %v", gw, labBridge, err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// 创建节点的master网卡，veth的主机端接入网桥
+func setupLabMaster(lc *labConfig, node labNode, br netlink.Link, gw *net.IPNet) error {
+	netns, err := ns.GetNS(netnsPath(node.Name))
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	if lc.MasterType == "dummy" {
+		err = inNamedNetns(node.Name, func() error {
+			return netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: labMasterName}})
+		})
+		if err != nil {
+			return fmt.Errorf("create dummy master for %s fail - %v", node.Name, err)
+		}
+	} else {
+		// 先在主机上使用临时名称创建，避免与主机上的网卡重名
+		peer := node.HostVeth + "p"
+		veth := &netlink.Veth{
+			LinkAttrs:     netlink.LinkAttrs{Name: node.HostVeth, MasterIndex: br.Attrs().Index},
+			PeerName:      peer,
+			PeerNamespace: netlink.NsFd(int(netns.Fd())),
+		}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return fmt.Errorf("create veth for %s fail - %v", node.Name, err)
+		}
+		host, err := netlink.LinkByName(node.HostVeth)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(host); err != nil {
+			return err
+		}
+		err = inNamedNetns(node.Name, func() error {
+			link, err := netlink.LinkByName(peer)
+			if err != nil {
+				return err
+			}
+			return netlink.LinkSetName(link, labMasterName)
+		})
+		if err != nil {
+			return fmt.Errorf("rename master for %s fail - %v", node.Name, err)
+		}
+	}
+
+	return inNamedNetns(node.Name, func() error {
+		for _, name := range []string{"lo", labMasterName} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+		}
+		master, err := netlink.LinkByName(labMasterName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(master, &netlink.Addr{IPNet: node.MasterIP}); err != nil {
+			return fmt.Errorf("add address %s fail - %v", node.MasterIP, err)
+		}
+		if lc.MasterType == "dummy" {
+			return nil
+		}
+		return netlink.RouteAdd(&netlink.Route{LinkIndex: master.Attrs().Index, Gw: gw.IP})
+	})
+}
+
+// 测试pod使用的CNI配置，与节点上的glued使用相同的命名空间路径
+func writeLabCNIConf(node labNode) (string, error) {
+	dir := filepath.Join(labConfDir, node.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	conf := map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"name":       "glue-lab",
+		"type":       "glue",
+		"nodeNetns":  node.Name,
+	}
+	buf, _ := json.MarshalIndent(conf, "", "  ")
+	path := filepath.Join(dir, "10-glue.conf")
+	return path, ioutil.WriteFile(path, buf, 0644)
+}
+
+// 输出加上节点名称前缀
+func prefixOutput(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Printf("[%s] %s\n", name, scanner.Text())
+	}
+}
+
+func startLabGlued(lc *labConfig, node labNode, index int) (*exec.Cmd, error) {
+	args := []string{
+		"-netns", node.Name,
+		"-pod-cidr", lc.PodCIDR,
+		"-service-cidr", lc.ServiceCIDR,
+		"-node-cidr", node.NodeCIDR,
+		"-stick-cni-type", lc.Type,
+		"-stick-cni-master", labMasterName,
+		"-stick-cni-mode", lc.Mode,
+		"-api-addr", fmt.Sprintf("127.0.0.1:%d", labAPIPortBase+index),
+		"-cni-conf-file", "",
+	}
+	cmd := exec.Command("/proc/self/exe", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start glued for %s fail - %v", node.Name, err)
+	}
+	go prefixOutput(node.Name, out)
+	return cmd, nil
+}
+
+// 清理实验环境，节点命名空间删除后其中的网卡（包括veth对端）随之删除
+func labDown() {
+	links, _ := netlink.LinkList()
+	for _, link := range links {
+		name := link.Attrs().Name
+		if len(name) > len(labHostVethPfx) && name[:len(labHostVethPfx)] == labHostVethPfx {
+			netlink.LinkDel(link)
+		}
+	}
+	if br, err := netlink.LinkByName(labBridge); err == nil {
+		netlink.LinkDel(br)
+	}
+
+	nsFiles, _ := filepath.Glob(netnsPath(labNodePrefix + "*"))
+	for _, path := range nsFiles {
+		name := filepath.Base(path)
+		fmt.Printf("Lab: remove node %s\n", name)
+		cmd := exec.Command("/proc/self/exe", "uninstall", "-netns", name)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fmt.Printf("Lab: uninstall %s fail - %v\n%s", name, err, out)
+		}
+		if err := deleteNamedNetns(name); err != nil {
+			fmt.Printf("Lab: %v\n", err)
+		}
+		os.RemoveAll(filepath.Join(glueRunDir, name))
+		os.RemoveAll(filepath.Join("/var/lib/cni/glue", name))
+		os.RemoveAll(filepath.Join("/var/lib/cni/networks", name))
+	}
+	os.RemoveAll(labConfDir)
+}
+
+func Lab(args []string) error {
+	lc := &labConfig{}
+	fs := flag.NewFlagSet("lab", flag.ContinueOnError)
+	fs.IntVar(&lc.Nodes, "nodes", 2, "number of simulated nodes")
+	fs.StringVar(&lc.PodCIDR, "pod-cidr", "10.244.0.0/16", "cluster podCIDR shared by all nodes")
+	fs.StringVar(&lc.ServiceCIDR, "service-cidr", "10.96.0.0/12", "cluster serviceCIDR")
+	fs.IntVar(&lc.NodeMask, "node-mask", 24, "mask size of each node CIDR")
+	fs.StringVar(&lc.LabCIDR, "lab-cidr", "192.168.250.0/24", "address range of node master netcards, the last address is on the bridge")
+	fs.StringVar(&lc.Type, "type", "macvlan", "stick cni type, macvlan/ipvlan")
+	fs.StringVar(&lc.Mode, "mode", "", "macvlan/ipvlan mode, default is bridge for macvlan and l2 for ipvlan")
+	fs.StringVar(&lc.MasterType, "master", "veth", "master netcard type, veth attached to the lab bridge or standalone dummy")
+	down := fs.Bool("down", false, "remove the lab left by a previous run and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *down {
+		labDown()
+		return nil
+	}
+
+	if lc.Mode == "" {
+		lc.Mode = "bridge"
+		if lc.Type == "ipvlan" {
+			lc.Mode = "l2"
+		}
+	}
+	if lc.MasterType != "veth" && lc.MasterType != "dummy" {
+		return fmt.Errorf("master type %s not supported, only support veth/dummy", lc.MasterType)
+	}
+	nodes, gw, err := planLabNodes(lc)
+	if err != nil {
+		return err
+	}
+
+	if _, err := netlink.LinkByName(labBridge); err == nil {
+		return fmt.Errorf("lab bridge %s exists, run 'glued lab -down' first", labBridge)
+	}
+
+	// 启动失败或退出时清理
+	var (
+		cmds []*exec.Cmd
+		lock sync.Mutex
+	)
+	cleanup := func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, cmd := range cmds {
+			cmd.Process.Signal(syscall.SIGTERM)
+			cmd.Wait()
+		}
+		cmds = nil
+		labDown()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	fmt.Printf("Lab: %d nodes, podCIDR %s, %s(%s) over %s master\n", lc.Nodes, lc.PodCIDR, lc.Type, lc.Mode, lc.MasterType)
+	br, err := setupLabBridge(gw)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	for i, node := range nodes {
+		if err := createNamedNetns(node.Name); err != nil {
+			cleanup()
+			return err
+		}
+		if err := setupLabMaster(lc, node, br, gw); err != nil {
+			cleanup()
+			return err
+		}
+		confPath, err := writeLabCNIConf(node)
+		if err != nil {
+			cleanup()
+			return err
+		}
+
+		lock.Lock()
+		cmd, err := startLabGlued(lc, node, i+1)
+		if err == nil {
+			cmds = append(cmds, cmd)
+		}
+		lock.Unlock()
+		if err != nil {
+			cleanup()
+			return err
+		}
+		fmt.Printf("Lab: node %s, nodeCIDR %s, master %s %s, cni conf %s\n",
+			node.Name, node.NodeCIDR, labMasterName, node.MasterIP, confPath)
+	}
+
+	fmt.Printf("Lab: ready, attach a test pod with\n")
+	fmt.Printf("    cd script/test && NETCONFPATH=%s CNI_PATH=/opt/cni/bin ./priv-net-run.sh <cmd>\n", filepath.Join(labConfDir, nodes[0].Name))
+
+	s := <-c
+	fmt.Printf("Lab: exit(%v), clean up...\n", s)
+	cleanup()
+	return nil
+}
@@ -7,7 +7,6 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 	"path/filepath"
@@ -19,12 +18,13 @@ import (
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 
-	"github.com/containernetworking/plugins/pkg/ip"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -49,6 +49,8 @@ type GlueSubnetConf struct {
 		Mode   string `yaml:"mode"`
 	}
 	DefaultNeighMac string `yaml:"defaultNeighMac,omitempty"`
+	Version         string            `json:"version,omitempty"`   // 写入子网文件的glued版本
+	Installed       map[string]string `json:"installed,omitempty"` // 安装的文件及其sha256
 }
 
 /*
@@ -80,6 +82,9 @@ func showGlueRunning(g *GlueSubnetConf) {
 	fmt.Printf("Glue running info: \n")
 	fmt.Printf("    kubeconfig file     : %s\n", *argKubeconfig)
 	fmt.Printf("    glue subnet file    : %s\n", *argSubnetFile)
+	if glueNetns != nil {
+		fmt.Printf("    netns               : %s\n", glueNetns.Path())
+	}
 	fmt.Printf("    pod CIDR            : %s\n", g.PodCIDR)
 	fmt.Printf("    service CIDR        : %s\n", g.ServiceCIDR)
 	fmt.Printf("    node CIDR           : %s\n", g.NodeCIDR)
@@ -88,6 +93,9 @@ func showGlueRunning(g *GlueSubnetConf) {
 	fmt.Printf("        master = %v\n", g.Master.Master)
 	fmt.Printf("        mode   = %v\n", g.Master.Mode)
 	fmt.Printf("    ipvlan default neigh mac : %s\n", g.DefaultNeighMac)
+	if natBackend != nil {
+		fmt.Printf("    nat backend         : %s\n", natBackend.Name())
+	}
 }
 
 var (
@@ -100,8 +108,28 @@ var (
 	argStickCniMaster *string
 	argStickCniMode   *string
 	argIpvlanNeighMac *string
+	argPodsDir        *string
+	argAPIAddr        *string
+	argMetricsAddr    *string
+	argNetworkTaint   *bool
+	argNatBackend     *string
+	argMasqEgress     *bool
+	argEnableCapture  *bool
+	argNonMasqCIDRs   *string
+	argRouteTable     *int
+	argDryRun         *bool
+	argNetns          *string
+	argCNIBinDir      *string
+	argCNIConfFile    *string
+	argCNINetworkName *string
+	argCNIVersion     *string
+	argCNIPlugins     *string
+
+	argReconcileInterval *time.Duration
 
 	subnetConf GlueSubnetConf
+
+	subnetFileWriteTime time.Time // 最近一次写子网文件的时间
 )
 
 func StringInArr(arr []string, toFind string) bool {
@@ -176,7 +204,8 @@ func getClusterCIDR(clientset *kubernetes.Clientset) (*CMClusterConfig, error) {
 	return nil, fmt.Errorf("ERROR: no Kubeadm ClusterConfiguration found\n")
 }
 
-func parseArg() error {
+// 定义命令行参数，glued和glued uninstall共用
+func defineFlags() {
 	//fmt.Printf("ARG: %+v\n", flag)
 	argKubeconfig = flag.String("kubeconfig-file", "", "(optional) absolute path to the kubeconfig file")
 	argSubnetFile = flag.String("subnet-file", defaultSubnetFile, "subnet file, default is "+defaultSubnetFile)
@@ -184,14 +213,39 @@ func parseArg() error {
 	argServiceCIDR = flag.String("service-cidr", "", "cluster serviceCIDR")
 	argNodeCIDR = flag.String("node-cidr", "", "node CIDR")
 
-	argStickCniType = flag.String("stick-cni-type", "macvlan", "Stick to CNI Plugin, support macvlan/ipvlan, default is macvlan")
-	argStickCniMaster = flag.String("stick-cni-master", "", "Stick to CNI Plugin, master netcard")
+	argStickCniType = flag.String("stick-cni-type", "macvlan", "Stick to CNI Plugin, support macvlan/ipvlan/auto, auto keeps the type in the subnet file or selects by preflight checks on first install, default is macvlan")
+	argStickCniMaster = flag.String("stick-cni-master", "", "Stick to CNI Plugin, master netcard name, or selector name=<regex>, cidr=<CIDR>, mac=<MAC>, node-internal-ip; default is the default route interface")
 	argStickCniMode = flag.String("stick-cni-mode", "bridge", "Stick to CNI Plugin, work mode")
 
 	argIpvlanNeighMac = flag.String("ipvlan-neigh-mac", "", "default neigh mac address for ipvlan")
+	argPodsDir = flag.String("pods-dir", defaultPodsDir, "pod records written by glue plugin, default is "+defaultPodsDir)
+	argNetworkTaint = flag.Bool("network-unavailable-taint", false, "taint the node with "+TaintNetworkUnavailable+" when glue network is broken")
+	argReconcileInterval = flag.Duration("reconcile-interval", defaultReconcileInterval, "interval to check and repair the node data plane")
+	argNatBackend = flag.String("nat-backend", NatBackendAuto, "nat rules backend, support auto/iptables/nftables, default is auto")
+	argMasqEgress = flag.Bool("masquerade-egress", false, "SNAT pod traffic leaving the cluster to the node address, default false keeps pod addresses as source")
+	argNonMasqCIDRs = flag.String("non-masquerade-cidrs", defaultNonMasqCIDRs, "comma separated CIDRs not to SNAT for pod egress, podCIDR is always included")
+	argRouteTable = flag.Int("route-table", defaultGlueRouteTable, "routing table for podCIDR traffic over the glue device")
+	argDryRun = flag.Bool("dry-run", false, "print planned changes against live state and exit without applying anything")
+	argNetns = flag.String("netns", "", "run the data plane in this network namespace, name under /var/run/netns or a path")
+	argCNIBinDir = flag.String("cni-bin-dir", defaultCNIBinDir, "directory of the delegate CNI plugins checked by preflight")
+	argCNIConfFile = flag.String("cni-conf-file", defaultCNIConfFile, "CNI conflist written once the node network is ready and removed when it is not, empty to disable")
+	argCNINetworkName = flag.String("cni-network-name", defaultCNINetworkName, "network name in the CNI conflist")
+	argCNIVersion = flag.String("cni-version", defaultCNIVersion, "cniVersion of the CNI conflist")
+	argCNIPlugins = flag.String("cni-plugins", defaultCNIPlugins, "comma separated plugins chained after glue, support portmap/bandwidth/tuning")
+	argAPIAddr = flag.String("api-addr", defaultAPIAddr, "glued http api listen address, empty to disable, default is "+defaultAPIAddr)
+	argMetricsAddr = flag.String("metrics-addr", "", "listen address serving only /metrics for prometheus scraping, e.g. 0.0.0.0:9751, empty to disable")
+	argEnableCapture = flag.Bool("enable-capture", false, "enable the /capture api to capture packets in pod network namespaces")
+
+}
 
+func parseArg() error {
+	defineFlags()
 	flag.Parse()
 
+	if err := OpenGlueNetns(*argNetns); err != nil {
+		return fmt.Errorf("ERROR: %v, check 'netns'\n", err)
+	}
+
 	// 检查参数
 	if *argPodCIDR != "" && (*argServiceCIDR == "" || *argNodeCIDR == "") {
 		return fmt.Errorf("ERROR: user-defined pod network, you must specify ServiceCIDR and NodeCIDR.\n")
@@ -199,9 +253,55 @@ func parseArg() error {
 	if *argKubeconfig == "" {
 		*argKubeconfig = filepath.Join(homedir.HomeDir(), ".kube", "config")
 	}
-	if *argStickCniType != "macvlan" && *argStickCniType != "ipvlan" {
-		return fmt.Errorf("ERROR: Only support macvlan/ipvlan, use 'stick-cni-type'\n")
+	if !StringInArr([]string{"macvlan", "ipvlan", "auto"}, *argStickCniType) {
+		return fmt.Errorf("ERROR: Only support macvlan/ipvlan/auto, use 'stick-cni-type'\n")
+	}
+
+	var master string
+	err := inGlueNetns(func() error {
+		var err error
+		master, err = SelectMaster(*argStickCniMaster)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("ERROR: select master netcard fail, check 'stick-cni-master' - %v\n", err)
 	}
+	if master != *argStickCniMaster {
+		fmt.Printf("Use interface %v as master netcard (selector: %q)\n", master, *argStickCniMaster)
+	}
+	argStickCniMaster = &master
+
+	// 检查内核和插件的支持情况，auto时选择可用的数据面
+	report := RunPreflight(master)
+	if *argStickCniType == "auto" {
+		modeSet := false
+		flag.Visit(func(f *flag.Flag) {
+			modeSet = modeSet || f.Name == "stick-cni-mode"
+		})
+
+		// 已安装的节点沿用子网文件中的数据面，重启时不切换类型影响已有的pod，仅首次安装时自动选择
+		if old, err := loadSubnetConf(*argSubnetFile); err == nil && StringInArr([]string{"macvlan", "ipvlan"}, old.Master.Type) {
+			fmt.Printf("Use datapath %s from subnet file %s\n", old.Master.Type, *argSubnetFile)
+			if !modeSet && old.Master.Mode != "" {
+				*argStickCniMode = old.Master.Mode
+			}
+			*argStickCniType = old.Master.Type
+		} else {
+			typ, err := report.selectDatapath()
+			if err != nil {
+				printPreflightReport(report)
+				return fmt.Errorf("ERROR: %v\n", err)
+			}
+			if typ == "ipvlan" && !modeSet {
+				*argStickCniMode = "l2"
+			}
+			*argStickCniType = typ
+		}
+	}
+	report.Datapath = *argStickCniType
+	printPreflightReport(report)
+	warnPreflight(report, *argStickCniType)
+
 	if *argStickCniType == "macvlan" && !StringInArr([]string{"bridge", "vepa", "passthru", "private"}, *argStickCniMode) {
 		return fmt.Errorf("ERROR: macvlan mode %s not supported, only support bridge, vepa, passthru and private\n", *argStickCniMode)
 	}
@@ -209,13 +309,25 @@ func parseArg() error {
 		return fmt.Errorf("ERROR: ipvlan mode %s not supported, only support l2, l3 or l3s\n", *argStickCniMode)
 	}
 
-	if *argStickCniMaster == "" {
-		master, err := GetDefaultGatewayInterface()
-		if err != nil {
-			return fmt.Errorf("ERROR: Must specify Master netcard, use 'stick-cni-master'\n")
-		}
-		argStickCniMaster = &master
-		fmt.Printf("Use default interface %v as master netcard\n", *argStickCniMaster)
+	if *argRouteTable <= 0 || *argRouteTable == unix.RT_TABLE_MAIN || *argRouteTable == unix.RT_TABLE_LOCAL || *argRouteTable == unix.RT_TABLE_DEFAULT || isEgressTable(*argRouteTable) {
+		return fmt.Errorf("ERROR: 'route-table' %d is reserved\n", *argRouteTable)
+	}
+
+	if _, err := ParseCNIPlugins(*argCNIPlugins); err != nil {
+		return fmt.Errorf("ERROR: %v, check 'cni-plugins'\n", err)
+	}
+
+	if *argReconcileInterval <= 0 {
+		return fmt.Errorf("ERROR: 'reconcile-interval' must be positive\n")
+	}
+
+	nonMasqueradeCIDRs, err = ParseNonMasqCIDRs(*argNonMasqCIDRs)
+	if err != nil {
+		return fmt.Errorf("ERROR: %v, check 'non-masquerade-cidrs'\n", err)
+	}
+
+	if err := inGlueNetns(func() error { return InitNatBackend(*argNatBackend) }); err != nil {
+		return fmt.Errorf("ERROR: %v, check 'nat-backend'\n", err)
 	}
 
 	if *argIpvlanNeighMac != "" {
@@ -233,6 +345,11 @@ func parseArg() error {
 	return nil
 }
 
+// glued状态文件与子网文件在同一目录
+func stateFilePath(name string) string {
+	return filepath.Join(filepath.Dir(*argSubnetFile), name)
+}
+
 func writeSubnetConf() error {
 	fmt.Printf("update subnet file : %v\n", *argSubnetFile)
 
@@ -244,92 +361,136 @@ func writeSubnetConf() error {
 		}
 	}
 
+	subnetConf.Version = glueVersion
 	buf, _ := json.Marshal(subnetConf)
-	return ioutil.WriteFile(*argSubnetFile, buf, 0600)
+	if err := ioutil.WriteFile(*argSubnetFile, buf, 0600); err != nil {
+		return err
+	}
+	subnetFileWriteTime = time.Now()
+	publishSubnetConf(subnetConf, subnetFileWriteTime)
+	return nil
+}
+
+// 处理本节点的变化，watch中断后重新建立
+func watchLocalNode(clientset *kubernetes.Clientset, nodeWatcher watch.Interface) {
+	for {
+		SetWatchLive(true)
+		for event := range nodeWatcher.ResultChan() {
+			p, ok := event.Object.(*apiv1.Node)
+			if !ok {
+				fmt.Printf("unexpected type\n")
+				continue
+			}
+			//fmt.Printf("Node Name is %+v\n", p.ObjectMeta.Name)
+			hn := getNodeName()
+			if p.ObjectMeta.Name != hn {
+				continue
+			}
+
+			fmt.Printf("Node %+v changed\n", hn)
+			if subnetConf.NodeCIDR == p.Spec.PodCIDR {
+				continue
+			}
+
+			// POD CIDR有更新，旧地址段在其中的pod全部删除后清理
+			if subnetConf.NodeCIDR != "" {
+				RetireNodeCIDR(subnetConf.NodeCIDR)
+			}
+			dataPlaneLock.Lock()
+			subnetConf.NodeCIDR = p.Spec.PodCIDR
+			dataPlaneLock.Unlock()
+			showGlueRunning(&subnetConf)
+			UpdateGlueConf()
+		}
+
+		fmt.Printf("node watch closed, rewatch...\n")
+		SetWatchLive(false)
+		metricNodeWatchReconnects.Inc()
+		for {
+			var err error
+			nodeWatcher, err = clientset.CoreV1().Nodes().Watch(context.TODO(), metav1.ListOptions{})
+			if err == nil {
+				break
+			}
+			fmt.Printf("Error: watch nodes fail - %v\n", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
 }
 
 func UpdateGlueConf() {
-	UpdateGlueDev(subnetConf)
+	dataPlaneLock.Lock()
+	err := inGlueNetns(func() error { return UpdateGlueDev(subnetConf) })
 	writeSubnetConf()
+	dataPlaneLock.Unlock()
+
+	// 上报需要访问apiserver，不持有数据面锁
+	ReportNodeNetwork(err)
 }
 
 func MainLoop() {
 	fmt.Printf("Enter main loop\n")
-	counter := 1
 	for {
-		time.Sleep(10 * time.Second)
-		//fmt.Printf("Counter = %d\n", counter)
-		counter++
+		time.Sleep(*argReconcileInterval)
+		ReconcileDataPlane()
 	}
 }
 
 func sysconfig() error {
-	err := ip.EnableIP4Forward()
+	err := inGlueNetns(func() error {
+		return ApplyHostSettings(GlueSubnetConf{}, func(format string, args ...interface{}) {
+			fmt.Printf("HostSettings: %s\n", fmt.Sprintf(format, args...))
+		})
+	})
 	if err != nil {
-		return fmt.Errorf("Could not enable IPv4 forwarding: %v", err)
+		return fmt.Errorf("Could not apply host settings: %v", err)
 	}
 	return nil
 }
 
+// 默认分离退出，保留内核配置和文件，新的实例启动后接管；完全清理使用 glued uninstall
 func tearDown(s os.Signal) {
 	switch s {
 	case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
-		fmt.Printf("\n\nProgram Exit, clean resources...\n", s)
-		CleanDevices()
-		CleanIptables()
-		CleanTcConfig()
-
-		// 清理待删除的文件
-		fmt.Printf("delete subnet file %v\n", *argSubnetFile)
-		os.Remove(*argSubnetFile)
-
-		env := os.Getenv("GLUE_FILES_TO_COPY_ON_BOOT")
-		//fmt.Printf("env GLUE_FILES_TO_COPY_ON_BOOT = %v\n", env)
-		if env != "" {
-			fmt.Printf("Delete file on delete...\n")
-			filesToRCopy := strings.Split(env, ",")
-			for _, pair := range filesToRCopy {
-				kv := strings.Split(pair, ":")
-				if len(kv) != 2 {
-					fmt.Printf("Invalid args in env GLUE_FILES_TO_COPY_ON_BOOT, arg = %s, skip\n", filesToRCopy)
-					continue
-				}
-
-				fmt.Printf("delete file %v\n", kv[1])
-				err := os.Remove(kv[1])
-				if err != nil {
-					fmt.Printf("ERROR: %v\n", err)
-				}
-			}
-		}
-
+		fmt.Printf("\n\nProgram Exit(%v), detach and keep the data plane, run 'glued uninstall' to clean up\n", s)
 		os.Exit(0)
 	default:
 		fmt.Println("other signal", s)
 	}
 }
 
-func copyFile(src string, dst string) error {
-	fmt.Printf("copy %v to %v\n", src, dst)
+func main() {
+	fmt.Printf("Glue %s\n", glueVersion)
 
-	input, err := ioutil.ReadFile(src)
-	if err != nil {
-		fmt.Println(err)
-		return fmt.Errorf("Read file %v err - %v", src, err)
+	// 卸载命令：glued uninstall [flags]
+	if len(os.Args) > 1 && os.Args[1] == "uninstall" {
+		if err := Uninstall(os.Args[2:]); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	err = ioutil.WriteFile(dst, input, 0755)
-	if err != nil {
-		return fmt.Errorf("creat file %v err - %v", dst, err)
+	// 检查内核和插件：glued preflight [flags]
+	if len(os.Args) > 1 && os.Args[1] == "preflight" {
+		if err := Preflight(os.Args[2:]); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	return nil
-}
 
-func main() {
-	fmt.Printf("Glue v0.1\n")
+	// 单机多节点实验环境：glued lab [flags]
+	if len(os.Args) > 1 && os.Args[1] == "lab" {
+		if err := Lab(os.Args[2:]); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	//监听指定信号 ctrl+c kill
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		for s := range c {
@@ -337,38 +498,31 @@ func main() {
 		}
 	}()
 
-	// 根据环境变量取值决定是否拷贝文件
-	env := os.Getenv("GLUE_FILES_TO_COPY_ON_BOOT")
-	//fmt.Printf("env GLUE_FILES_TO_COPY_ON_BOOT = %v\n", env)
-	if env != "" {
-		fmt.Printf("Copy file on boot...\n")
-		filesToRCopy := strings.Split(env, ",")
-		for _, pair := range filesToRCopy {
-			kv := strings.Split(pair, ":")
-			if len(kv) != 2 {
-				fmt.Printf("Invalid args in env GLUE_FILES_TO_COPY_ON_BOOT, arg = %s, skip\n", filesToRCopy)
-				continue
-			}
+	// 参数解析
+	if err := parseArg(); err != nil {
+		fmt.Printf("%vl\n", err)
+		return
+	}
 
-			os.Remove(kv[1])
-			err := copyFile(kv[0], kv[1])
-			if err != nil {
-				fmt.Printf("ERROR: %v\n", err)
-			}
-		}
+	// 预演模式，不修改任何配置
+	if *argDryRun {
+		os.Exit(DryRun())
 	}
 
-	// 基础配置
+	// 根据环境变量取值安装插件和配置文件
+	InstallBootFiles()
+
+	// 基础配置，依赖参数中的数据目录
 	if err := sysconfig(); err != nil {
 		fmt.Printf("%vl\n", err)
 		return
 	}
 
-	// 参数解析
-	if err := parseArg(); err != nil {
-		fmt.Printf("%vl\n", err)
-		return
-	}
+	// 接管上一个实例留下的配置
+	adoptExistingState()
+
+	StartAPIServer(*argAPIAddr)
+	StartMetricsServer(*argMetricsAddr)
 
 	// 获取cluster配置，优先使用用户参数中指定的网络配置
 	fmt.Printf("Parse podCIDR\n")
@@ -391,6 +545,7 @@ func main() {
 			fmt.Printf("Error: getClientSet fail\n")
 			return
 		}
+		kubeClient = clientset
 
 		conf, err := getClusterCIDR(clientset)
 		if err != nil {
@@ -413,31 +568,16 @@ func main() {
 			return
 		}
 
-		go func() {
-			for event := range nodeWatcher.ResultChan() {
-				p, ok := event.Object.(*apiv1.Node)
-				if !ok {
-					fmt.Printf("unexpected type\n")
-				}
-				//fmt.Printf("Node Name is %+v\n", p.ObjectMeta.Name)
-				hn, _ := os.Hostname()
-				if p.ObjectMeta.Name != hn {
-					continue
-				}
-
-				fmt.Printf("Node %+v changed\n", hn)
-				if subnetConf.NodeCIDR == p.Spec.PodCIDR {
-					continue
-				}
-
-				// POD CIDR有更新
-				subnetConf.NodeCIDR = p.Spec.PodCIDR
-				showGlueRunning(&subnetConf)
-				UpdateGlueConf()
-			}
-		}()
+		go watchLocalNode(clientset, nodeWatcher)
+
+		// watch本节点pod，处理pod annotation
+		go WatchLocalPods(clientset)
+		go WatchEgress(clientset)
 	}
 
+	// 监听master网卡的变化
+	go WatchNetlink()
+
 	MainLoop()
 	return
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	masterSelectorNodeIP = "node-internal-ip"
+)
+
+/*
+stick-cni-master 支持以下写法：
+
+	enp0s8               直接指定网卡名称
+	name=^enp0s[0-9]+$   网卡名称正则，必须只匹配一个网卡
+	cidr=192.168.56.0/24 网卡上有该网段内的地址
+	mac=08:00:27:aa:bb:cc 网卡MAC地址，bond成员和VLAN子接口与上层网卡MAC相同时选不属于其他设备的非VLAN网卡
+	node-internal-ip     使用持有Node InternalIP的网卡，需要访问kubernetes
+	为空                 使用默认路由所在的网卡
+*/
+type masterCandidate struct {
+	Name  string
+	MAC   string
+	Addrs []string
+	Slave bool // 属于bond/bridge等其他设备
+	VLAN  bool
+}
+
+func (c masterCandidate) String() string {
+	return fmt.Sprintf("%s(mac=%s, addrs=%s)", c.Name, c.MAC, strings.Join(c.Addrs, ","))
+}
+
+// glue创建的设备：glue设备、镜像设备、预检探测设备及实验环境的网桥和veth，与master的MAC相同或地址相近
+func isGlueCreatedDevice(name string) bool {
+	if name == DefaltGlueDeviceName || name == labBridge || isMirrorDevice(name) {
+		return true
+	}
+	for _, prefix := range []string{preflightProbePrefix, labHostVethPfx} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 列出可以作为master的物理/虚拟网卡，排除lo及glue创建的设备
+func listMasterCandidates() ([]masterCandidate, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []masterCandidate
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 || isGlueCreatedDevice(attrs.Name) {
+			continue
+		}
+		c := masterCandidate{
+			Name:  attrs.Name,
+			MAC:   attrs.HardwareAddr.String(),
+			Slave: attrs.MasterIndex != 0,
+			VLAN:  link.Type() == "vlan",
+		}
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		for _, a := range addrs {
+			c.Addrs = append(c.Addrs, a.IPNet.String())
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+func candidateHasIP(c masterCandidate, match func(ip net.IP) bool) bool {
+	for _, a := range c.Addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err == nil && match(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func getNodeInternalIP() (net.IP, error) {
+	clientset, err := getClientSet()
+	if err != nil {
+		return nil, fmt.Errorf("%s needs kubernetes access - %v", masterSelectorNodeIP, err)
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), getNodeName(), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get node %s fail - %v", getNodeName(), err)
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == apiv1.NodeInternalIP {
+			if ip := net.ParseIP(addr.Address); ip != nil && ip.To4() != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("node %s has no IPv4 InternalIP", getNodeName())
+}
+
+// 根据选择器选出唯一的master网卡
+func SelectMaster(selector string) (string, error) {
+	if selector == "" {
+		return GetDefaultGatewayInterface()
+	}
+
+	kv := strings.SplitN(selector, "=", 2)
+	if len(kv) == 1 && selector != masterSelectorNodeIP {
+		// 网卡名称
+		if _, err := netlink.LinkByName(selector); err != nil {
+			return "", fmt.Errorf("master netcard %s not found", selector)
+		}
+		return selector, nil
+	}
+
+	candidates, err := listMasterCandidates()
+	if err != nil {
+		return "", err
+	}
+
+	var match func(c masterCandidate) bool
+	switch {
+	case selector == masterSelectorNodeIP:
+		nodeIP, err := getNodeInternalIP()
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("Node InternalIP is %v\n", nodeIP)
+		match = func(c masterCandidate) bool {
+			return candidateHasIP(c, func(ip net.IP) bool { return ip.Equal(nodeIP) })
+		}
+	case kv[0] == "name":
+		re, err := regexp.Compile(kv[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid name regex %q - %v", kv[1], err)
+		}
+		match = func(c masterCandidate) bool { return re.MatchString(c.Name) }
+	case kv[0] == "cidr":
+		_, ipnet, err := net.ParseCIDR(kv[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid cidr %q - %v", kv[1], err)
+		}
+		match = func(c masterCandidate) bool { return candidateHasIP(c, ipnet.Contains) }
+	case kv[0] == "mac":
+		mac, err := net.ParseMAC(kv[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid mac %q - %v", kv[1], err)
+		}
+		match = func(c masterCandidate) bool { return strings.EqualFold(c.MAC, mac.String()) }
+	default:
+		return "", fmt.Errorf("unsupported master selector %q, use name=, cidr=, mac= or %s", selector, masterSelectorNodeIP)
+	}
+
+	var matched []masterCandidate
+	for _, c := range candidates {
+		if match(c) {
+			matched = append(matched, c)
+		}
+	}
+
+	// 同一MAC可能同时出现在bond及其成员、网卡及其VLAN子接口上，取最上层的网卡
+	if kv[0] == "mac" && len(matched) > 1 {
+		var top []masterCandidate
+		for _, c := range matched {
+			if !c.Slave && !c.VLAN {
+				top = append(top, c)
+			}
+		}
+		if len(top) == 1 {
+			fmt.Printf("master selector %q matched %d netcards, use %s\n", selector, len(matched), top[0].Name)
+			matched = top
+		}
+	}
+
+	switch len(matched) {
+	case 1:
+		return matched[0].Name, nil
+	case 0:
+		var all []string
+		for _, c := range candidates {
+			all = append(all, c.String())
+		}
+		return "", fmt.Errorf("master selector %q matched no netcard, candidates: %s", selector, strings.Join(all, "; "))
+	default:
+		var names []string
+		for _, c := range matched {
+			names = append(names, c.String())
+		}
+		return "", fmt.Errorf("master selector %q matched more than one netcard: %s", selector, strings.Join(names, "; "))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+/*
+Prometheus文本格式的指标输出，各模块注册采集函数：
+
+	curl http://127.0.0.1:9750/metrics
+
+API默认只监听127.0.0.1，Prometheus需要抓取时用-metrics-addr单独监听，只提供/metrics
+*/
+type MetricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type metricFamily struct {
+	Name    string
+	Help    string
+	Type    string // counter/gauge
+	Collect func() []MetricSample
+}
+
+var (
+	metricsLock    sync.Mutex
+	metricFamilies []metricFamily
+
+	// 最近一次写入子网文件的配置，指标只读取该副本，不等待数据面锁
+	publishedLock      sync.Mutex
+	publishedConf      GlueSubnetConf
+	publishedWriteTime time.Time
+)
+
+func RegisterMetric(name, help, typ string, collect func() []MetricSample) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricFamilies = append(metricFamilies, metricFamily{Name: name, Help: help, Type: typ, Collect: collect})
+}
+
+// 带一个标签的计数器
+type CounterVec struct {
+	lock   sync.Mutex
+	label  string
+	values map[string]float64
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{label: label, values: map[string]float64{}}
+	RegisterMetric(name, help, "counter", c.collect)
+	return c
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.lock.Lock()
+	c.values[value]++
+	c.lock.Unlock()
+}
+
+func (c *CounterVec) collect() []MetricSample {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var samples []MetricSample
+	for v, n := range c.values {
+		samples = append(samples, MetricSample{Labels: map[string]string{c.label: v}, Value: n})
+	}
+	return samples
+}
+
+// 无标签的计数器
+type Counter struct {
+	lock  sync.Mutex
+	value float64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	RegisterMetric(name, help, "counter", func() []MetricSample {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return []MetricSample{{Value: c.value}}
+	})
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.lock.Lock()
+	c.value++
+	c.lock.Unlock()
+}
+
+func GaugeFunc(name, help string, get func() float64) {
+	RegisterMetric(name, help, "gauge", func() []MetricSample {
+		return []MetricSample{{Value: get()}}
+	})
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsLock.Lock()
+	families := make([]metricFamily, len(metricFamilies))
+	copy(families, metricFamilies)
+	metricsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.Name, f.Help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Collect() {
+			fmt.Fprintf(w, "%s%s %v\n", f.Name, formatLabels(s.Labels), s.Value)
+		}
+	}
+}
+
+var (
+	metricReconcileTotal      = NewCounterVec("glue_reconcile_total", "Reconcile attempts by component (device/route/nat/tc).", "component")
+	metricReconcileErrors     = NewCounterVec("glue_reconcile_errors_total", "Reconcile failures by component (device/route/nat/tc).", "component")
+	metricNodeWatchReconnects = NewCounter("glue_node_watch_reconnects_total", "Times the node watch was re-established.")
+)
+
+// 记录各组件的调和结果，返回原错误
+func recordReconcile(component string, err error) error {
+	metricReconcileTotal.Inc(component)
+	if err != nil {
+		metricReconcileErrors.Inc(component)
+	}
+	return err
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func linkUp(name string) (exists bool, up bool) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, false
+	}
+	return true, link.Attrs().Flags&net.FlagUp != 0
+}
+
+// 写子网文件后发布配置副本
+func publishSubnetConf(conf GlueSubnetConf, written time.Time) {
+	conf.Installed = nil
+	publishedLock.Lock()
+	publishedConf, publishedWriteTime = conf, written
+	publishedLock.Unlock()
+}
+
+func metricsSnapshot() (GlueSubnetConf, time.Time) {
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	return publishedConf, publishedWriteTime
+}
+
+// 本节点地址池容量和已分配数量，已分配数量根据pod记录统计
+func ipamUsage() (capacity float64, used float64) {
+	conf, _ := metricsSnapshot()
+	if conf.NodeCIDR == "" || conf.PodCIDR == "" {
+		return 0, 0
+	}
+	start, end, _, _, _, err := getNetInfo(&conf)
+	if err != nil {
+		return 0, 0
+	}
+	s, e := Ipv4ToUint32(start.To4()), Ipv4ToUint32(end.To4())
+	if e >= s {
+		capacity = float64(e - s + 1)
+	}
+
+	recs, _ := ListPodRecords()
+	for _, rec := range recs {
+		for _, ip := range rec.IPs {
+			if v4 := net.ParseIP(ip).To4(); v4 != nil {
+				if i := Ipv4ToUint32(v4); i >= s && i <= e {
+					used++
+				}
+			}
+		}
+	}
+	return capacity, used
+}
+
+func init() {
+	RegisterAPI("/metrics", metricsHandler)
+
+	GaugeFunc("glue_device_exists", "Whether the glue device exists.", func() float64 {
+		exists, _ := linkUp(DefaltGlueDeviceName)
+		return boolToFloat(exists)
+	})
+	GaugeFunc("glue_device_up", "Whether the glue device is up.", func() float64 {
+		_, up := linkUp(DefaltGlueDeviceName)
+		return boolToFloat(up)
+	})
+	RegisterMetric("glue_master_up", "Whether the master netcard is up.", "gauge", func() []MetricSample {
+		conf, _ := metricsSnapshot()
+		_, up := linkUp(conf.Master.Master)
+		return []MetricSample{{Labels: map[string]string{"master": conf.Master.Master}, Value: boolToFloat(up)}}
+	})
+	RegisterMetric("glue_config_info", "Currently applied glue network config.", "gauge", func() []MetricSample {
+		conf, _ := metricsSnapshot()
+		return []MetricSample{{Labels: map[string]string{
+			"pod_cidr":     conf.PodCIDR,
+			"service_cidr": conf.ServiceCIDR,
+			"node_cidr":    conf.NodeCIDR,
+			"type":         conf.Master.Type,
+			"master":       conf.Master.Master,
+			"mode":         conf.Master.Mode,
+		}, Value: 1}}
+	})
+	GaugeFunc("glue_ipam_capacity", "Number of pod addresses available in the node range.", func() float64 {
+		capacity, _ := ipamUsage()
+		return capacity
+	})
+	GaugeFunc("glue_ipam_used", "Number of pod addresses in use in the node range.", func() float64 {
+		_, used := ipamUsage()
+		return used
+	})
+	GaugeFunc("glue_subnet_file_age_seconds", "Seconds since the subnet file was last written, -1 if never written.", func() float64 {
+		_, written := metricsSnapshot()
+		if written.IsZero() {
+			return -1
+		}
+		return time.Since(written).Seconds()
+	})
+}
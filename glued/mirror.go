@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	AnnotationMirror = "glue.io/mirror"
+
+	// glued创建的镜像设备名称前缀，只使用和删除带有这些前缀的设备
+	mirrorGrePrefix    = "gmir-" // gmir-<采集器地址>
+	mirrorErspanPrefix = "gmer"  // gmer<采集器地址><session id>
+	mirrorDevPrefix    = "gmd-"  // gmd-<名称>
+
+	defaultErspanSession = 1
+	maxErspanSession     = 1023
+
+	// linux/if_tunnel.h，vishvananda/netlink中未定义
+	iflaGreErspanIndex = 21
+	iflaGreErspanVer   = 22
+)
+
+/*
+pod流量镜像：
+
+	glue.io/mirror: dev:cap0              镜像到本地dummy设备gmd-cap0，不存在时创建
+	glue.io/mirror: gre:10.0.0.9          镜像到GRE隧道，隧道对端为采集器地址
+	glue.io/mirror: erspan:10.0.0.9/100   镜像到ERSPAN(type II)隧道，session id为100，不指定时为1
+
+镜像目的设备都由glued创建并带有glue的前缀，已有的其他设备不能作为镜像目的，避免镜像流量发往业务网卡。
+
+macvlan/ipvlan子接口的流量不经过主机协议栈，但都会经过master网卡的clsact：
+
+	tc filter add dev enp0s8 ingress prio 30000 proto ip u32 match ip dst 172.24.0.5/32 action mirred egress mirror dev cap0 continue
+	tc filter add dev enp0s8 egress prio 30000 proto ip u32 match ip src 172.24.0.5/32 action mirred egress mirror dev cap0 continue
+*/
+type mirrorState struct {
+	ContainerID string
+	Spec        string
+	Target      string // 镜像目的设备
+	IPs         []string
+}
+
+var (
+	mirrorLock    sync.Mutex
+	mirrorApplied = map[string]mirrorState{}
+)
+
+var (
+	clsactIngressParent = uint32(netlink.HANDLE_CLSACT&0xffff0000 | netlink.HANDLE_MIN_INGRESS&0x0000ffff)
+	clsactEgressParent  = uint32(netlink.HANDLE_CLSACT&0xffff0000 | netlink.HANDLE_MIN_EGRESS&0x0000ffff)
+)
+
+func parseMirrorSpec(spec string) (kind string, value string, err error) {
+	kv := strings.SplitN(spec, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return "", "", fmt.Errorf("invalid mirror target %q, use dev:<name>, gre:<collector ip> or erspan:<collector ip>[/<session id>]", spec)
+	}
+
+	switch kv[0] {
+	case "dev":
+		if len(mirrorDevPrefix+kv[1]) > 15 || strings.ContainsAny(kv[1], "/: ") {
+			return "", "", fmt.Errorf("invalid device name %q, at most %d characters", kv[1], 15-len(mirrorDevPrefix))
+		}
+	case "gre":
+		if ip := net.ParseIP(kv[1]); ip == nil || ip.To4() == nil {
+			return "", "", fmt.Errorf("invalid collector ip %q", kv[1])
+		}
+	case "erspan":
+		if _, _, err := parseErspanTarget(kv[1]); err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported mirror type %q", kv[0])
+	}
+	return kv[0], kv[1], nil
+}
+
+// <采集器地址>[/<session id>]
+func parseErspanTarget(value string) (net.IP, uint32, error) {
+	ipstr, session := value, uint64(defaultErspanSession)
+	if i := strings.Index(value, "/"); i >= 0 {
+		ipstr = value[:i]
+		n, err := strconv.ParseUint(value[i+1:], 10, 32)
+		if err != nil || n > maxErspanSession {
+			return nil, 0, fmt.Errorf("invalid erspan session id %q, should be 0-%d", value[i+1:], maxErspanSession)
+		}
+		session = n
+	}
+	ip := net.ParseIP(ipstr).To4()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid collector ip %q", ipstr)
+	}
+	return ip, uint32(session), nil
+}
+
+// glued创建的镜像设备
+func isMirrorDevice(name string) bool {
+	for _, prefix := range []string{mirrorGrePrefix, mirrorErspanPrefix, mirrorDevPrefix} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+创建ERSPAN type II设备，vishvananda/netlink不支持erspan类型，直接发送RTM_NEWLINK：
+
+	ip link add gmer0a000009064 type erspan seq key 100 local 192.168.56.11 remote 10.0.0.9 erspan_ver 1
+*/
+func addErspanLink(name string, local, remote net.IP, session uint32) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(name)))
+
+	// ERSPAN要求同时带有GRE的seq和key标志
+	flags := make([]byte, 2)
+	binary.BigEndian.PutUint16(flags, 0x3000)
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, session)
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("erspan"))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(nl.IFLA_GRE_LOCAL, []byte(local.To4()))
+	data.AddRtAttr(nl.IFLA_GRE_REMOTE, []byte(remote.To4()))
+	data.AddRtAttr(nl.IFLA_GRE_TTL, nl.Uint8Attr(64))
+	data.AddRtAttr(nl.IFLA_GRE_PMTUDISC, nl.Uint8Attr(1))
+	data.AddRtAttr(nl.IFLA_GRE_IFLAGS, flags)
+	data.AddRtAttr(nl.IFLA_GRE_OFLAGS, flags)
+	data.AddRtAttr(nl.IFLA_GRE_IKEY, key)
+	data.AddRtAttr(nl.IFLA_GRE_OKEY, key)
+	data.AddRtAttr(iflaGreErspanVer, nl.Uint8Attr(1))
+	data.AddRtAttr(iflaGreErspanIndex, nl.Uint32Attr(0))
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func getLinkIPv4(link netlink.Link) (net.IP, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no ipv4 address on %s", link.Attrs().Name)
+	}
+	return addrs[0].IP, nil
+}
+
+// 隧道的本端地址使用master网卡的地址
+func mirrorLocalIP() (net.IP, error) {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return nil, err
+	}
+	return getLinkIPv4(master)
+}
+
+// 准备镜像目的设备，返回设备名称
+func ensureMirrorTarget(kind, value string) (string, error) {
+	var name, typ string
+
+	switch kind {
+	case "dev":
+		name, typ = mirrorDevPrefix+value, "dummy"
+	case "gre":
+		remote := net.ParseIP(value).To4()
+		name, typ = fmt.Sprintf("%s%08x", mirrorGrePrefix, Ipv4ToUint32(remote)), "gretap"
+	case "erspan":
+		remote, session, _ := parseErspanTarget(value)
+		name, typ = fmt.Sprintf("%s%08x%03x", mirrorErspanPrefix, Ipv4ToUint32(remote), session), "erspan"
+	}
+
+	// 同名设备须为glued创建的同类型设备
+	if link, err := netlink.LinkByName(name); err == nil {
+		if link.Type() != typ {
+			return "", fmt.Errorf("device %s exists with type %s, not a glue %s mirror device", name, link.Type(), typ)
+		}
+		return name, nil
+	}
+
+	fmt.Printf("Mirror: create mirror device %s(%s)\n", name, typ)
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	var err error
+	switch kind {
+	case "dev":
+		err = netlink.LinkAdd(&netlink.Dummy{LinkAttrs: la})
+	case "gre":
+		var local net.IP
+		if local, err = mirrorLocalIP(); err == nil {
+			err = netlink.LinkAdd(&netlink.Gretap{
+				LinkAttrs: la,
+				Local:     local,
+				Remote:    net.ParseIP(value).To4(),
+				Ttl:       64,
+				PMtuDisc:  1,
+			})
+		}
+	case "erspan":
+		var local net.IP
+		if local, err = mirrorLocalIP(); err == nil {
+			remote, session, _ := parseErspanTarget(value)
+			err = addErspanLink(name, local, remote, session)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("create mirror device %s fail - %v", name, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// 没有pod使用时删除glued创建的镜像设备
+func releaseMirrorTarget(name string) {
+	if !isMirrorDevice(name) {
+		return
+	}
+	for _, st := range mirrorApplied {
+		if st.Target == name {
+			return
+		}
+	}
+
+	fmt.Printf("Mirror: delete mirror device %s\n", name)
+	if link, err := netlink.LinkByName(name); err == nil {
+		netlink.LinkDel(link)
+	}
+}
+
+func mirrorFilters(masterIndex int, ipstr string) (ingress *netlink.U32, egress *netlink.U32) {
+	ipnet := &net.IPNet{IP: net.ParseIP(ipstr), Mask: net.CIDRMask(32, 32)}
+
+	ingress = createTCU32FilterAt(masterIndex, ipnet, tcU32OffDstIP, tcPrioMirror)
+	ingress.Parent = clsactIngressParent
+
+	egress = createTCU32FilterAt(masterIndex, ipnet, tcU32OffSrcIP, tcPrioMirror)
+	egress.Parent = clsactEgressParent
+	return ingress, egress
+}
+
+func delTCFilterLike(link netlink.Link, f *netlink.U32) {
+	filters, err := netlink.FilterList(link, f.Parent)
+	if err != nil {
+		return
+	}
+	for _, filter := range filters {
+		if u32FilterEqual(f, filter) {
+			netlink.FilterDel(filter)
+		}
+	}
+}
+
+// 删除master上指定优先级的glue filter中不再需要的，用于清理glued停止期间删除的pod遗留的规则
+func sweepTCFilters(link netlink.Link, prio uint16, keep func(f *netlink.U32) bool) {
+	for _, parent := range []uint32{clsactIngressParent, clsactEgressParent} {
+		filters, err := netlink.FilterList(link, parent)
+		if err != nil {
+			continue
+		}
+		for _, filter := range filters {
+			u32f, ok := filter.(*netlink.U32)
+			if !ok || u32f.Priority != prio || !isGlueTcFilter(filter, 0) || keep(u32f) {
+				continue
+			}
+			fmt.Printf("delete stale tc filter on %s, prio %d key %+v\n", link.Attrs().Name, prio, u32f.Sel.Keys[0])
+			if err := netlink.FilterDel(filter); err != nil {
+				fmt.Printf("delete stale tc filter fail - %v\n", err)
+			}
+		}
+	}
+}
+
+func delPodMirror(st mirrorState) {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return
+	}
+
+	for _, ip := range st.IPs {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		ingress, egress := mirrorFilters(master.Attrs().Index, ip)
+		delTCFilterLike(master, ingress)
+		delTCFilterLike(master, egress)
+	}
+}
+
+func addPodMirror(st mirrorState) error {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return err
+	}
+	target, err := netlink.LinkByName(st.Target)
+	if err != nil {
+		return err
+	}
+
+	if err := addClsact(master); err != nil {
+		return err
+	}
+
+	for _, ip := range st.IPs {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		ingress, egress := mirrorFilters(master.Attrs().Index, ip)
+		for _, f := range []*netlink.U32{ingress, egress} {
+			delTCFilterLike(master, f)
+			f.Actions = creatTCMirrorActions(target.Attrs().Index)
+			if err := netlink.FilterAdd(f); err != nil {
+				return fmt.Errorf("add mirror filter for %s error, %w", ip, err)
+			}
+		}
+	}
+	return nil
+}
+
+func mirrorOnUpdate(pod *apiv1.Pod) error {
+	key := podKey(pod)
+	spec := strings.TrimSpace(pod.Annotations[AnnotationMirror])
+
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+
+	applied, ok := mirrorApplied[key]
+	if !ok && spec == "" {
+		return nil
+	}
+
+	rec, err := FindPodRecord(pod.Namespace, pod.Name)
+	if err != nil {
+		return nil
+	}
+	if ok && applied.Spec == spec && applied.ContainerID == rec.ContainerID {
+		return nil
+	}
+
+	if ok {
+		fmt.Printf("Mirror: stop mirror pod %s to %s\n", key, applied.Target)
+		delPodMirror(applied)
+		delete(mirrorApplied, key)
+		releaseMirrorTarget(applied.Target)
+	}
+	if spec == "" {
+		return nil
+	}
+
+	kind, value, err := parseMirrorSpec(spec)
+	if err != nil {
+		return fmt.Errorf("annotation %s: %v", AnnotationMirror, err)
+	}
+	target, err := ensureMirrorTarget(kind, value)
+	if err != nil {
+		return err
+	}
+
+	st := mirrorState{
+		ContainerID: rec.ContainerID,
+		Spec:        spec,
+		Target:      target,
+		IPs:         rec.IPs,
+	}
+	if len(st.IPs) == 0 && pod.Status.PodIP != "" {
+		st.IPs = []string{pod.Status.PodIP}
+	}
+	fmt.Printf("Mirror: mirror pod %s %v to %s\n", key, st.IPs, target)
+	mirrorApplied[key] = st
+	if err := addPodMirror(st); err != nil {
+		delPodMirror(st)
+		delete(mirrorApplied, key)
+		releaseMirrorTarget(target)
+		return err
+	}
+	return nil
+}
+
+func mirrorOnDelete(pod *apiv1.Pod) error {
+	key := podKey(pod)
+
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+
+	applied, ok := mirrorApplied[key]
+	if !ok {
+		return nil
+	}
+	fmt.Printf("Mirror: pod %s deleted, stop mirror\n", key)
+	delPodMirror(applied)
+	delete(mirrorApplied, key)
+	releaseMirrorTarget(applied.Target)
+	return nil
+}
+
+// 退出时清理所有镜像配置
+func CleanMirror() {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+
+	for key, st := range mirrorApplied {
+		delPodMirror(st)
+		delete(mirrorApplied, key)
+		releaseMirrorTarget(st.Target)
+	}
+}
+
+/*
+glued重启或master重建后只有仍带annotation的pod重新下发，全部pod处理完成后清理：
+
+	不属于当前镜像记录的镜像filter，包括目的设备已删除的
+	不再使用的镜像设备
+*/
+func mirrorOnSynced() {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+
+	if master, err := netlink.LinkByName(subnetConf.Master.Master); err == nil {
+		var wanted []*netlink.U32
+		for _, st := range mirrorApplied {
+			target, err := netlink.LinkByName(st.Target)
+			if err != nil {
+				continue
+			}
+			for _, ip := range st.IPs {
+				if net.ParseIP(ip).To4() == nil {
+					continue
+				}
+				ingress, egress := mirrorFilters(master.Attrs().Index, ip)
+				for _, f := range []*netlink.U32{ingress, egress} {
+					f.Actions = creatTCMirrorActions(target.Attrs().Index)
+					wanted = append(wanted, f)
+				}
+			}
+		}
+		// 方向由匹配的偏移区分，列出的filter的Parent不一定准确
+		sweepTCFilters(master, tcPrioMirror, func(f *netlink.U32) bool {
+			for _, w := range wanted {
+				if u32FilterEqual(w, f) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return
+	}
+	for _, link := range links {
+		releaseMirrorTarget(link.Attrs().Name)
+	}
+}
+
+func mirrorOnReset() {
+	mirrorLock.Lock()
+	mirrorApplied = map[string]mirrorState{}
+	mirrorLock.Unlock()
+}
+
+func init() {
+	RegisterPodHandler(PodHandler{
+		Name:     "Mirror",
+		OnUpdate: mirrorOnUpdate,
+		OnDelete: mirrorOnDelete,
+		OnReset:  mirrorOnReset,
+		OnSynced: mirrorOnSynced,
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NatBackendAuto     = "auto"
+	NatBackendIptables = "iptables"
+	NatBackendNftables = "nftables"
+
+	natRetryInterval = 5 * time.Second
+
+	// pod经glue设备访问服务时打的标记，与kube-proxy的0x4000/0x8000区分
+	glueMasqMark = 0x1000
+)
+
+// 参考ip-masq-agent，默认不做SNAT的目的地址
+const defaultNonMasqCIDRs = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,169.254.0.0/16," +
+	"192.0.0.0/24,192.0.2.0/24,192.88.99.0/24,198.18.0.0/15,198.51.100.0/24,203.0.113.0/24,240.0.0.0/4"
+
+/*
+glue的地址转换规则后端：
+
+	iptables: 在nat表中创建GLUE-PREROUTING/GLUE-POSTROUTING链
+	nftables: 创建独立的glue表，包含prerouting/postrouting链
+
+两种后端规则相同，不依赖kube-proxy的链：
+
+ 1. pod经glue设备访问服务的流量打标记并做SNAT，回包经过节点，避免同节点pod直接二层回包
+ 2. 开启 masquerade-egress 时（默认关闭），pod访问集群外的流量做SNAT，不做SNAT的地址段由 non-masquerade-cidrs 指定，podCIDR始终不做SNAT
+    macvlan的pod默认网关为glue设备；ipvlan的pod出集群流量不经过节点，仅1生效
+*/
+type NatBackend interface {
+	Name() string
+	// 同步期望规则，返回是否有修改
+	Sync(conf GlueSubnetConf) (bool, error)
+	// 检查规则是否与期望一致
+	Check(conf GlueSubnetConf) error
+	// 预演模式，计算需要修改的规则
+	Plan(conf GlueSubnetConf) ([]planItem, error)
+	Clean() error
+}
+
+var (
+	natBackend NatBackend
+
+	nonMasqueradeCIDRs []string
+
+	natRetryLock    sync.Mutex
+	natRetryRunning bool
+)
+
+func newNatBackend(name string) (NatBackend, error) {
+	switch name {
+	case NatBackendIptables:
+		return &iptablesBackend{}, nil
+	case NatBackendNftables:
+		return &nftablesBackend{}, nil
+	case NatBackendAuto:
+		return newNatBackend(detectNatBackend())
+	}
+	return nil, fmt.Errorf("unknown nat backend %q, support auto/iptables/nftables", name)
+}
+
+/*
+自动选择后端：
+
+	kube-proxy工作在nftables模式(存在 ip kube-proxy 表)时使用nftables
+	存在KUBE-MARK-MASQ链时使用iptables
+	没有iptables命令时使用nftables，其他情况默认iptables
+*/
+func detectNatBackend() string {
+	if nftTableExists("kube-proxy") {
+		return NatBackendNftables
+	}
+	if kubeMarkMasqExists() {
+		return NatBackendIptables
+	}
+	// nftables后端通过netlink配置，不依赖nft命令
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return NatBackendNftables
+	}
+	return NatBackendIptables
+}
+
+// 解析不做SNAT的地址段，逗号分隔
+func ParseNonMasqCIDRs(s string) ([]string, error) {
+	var cidrs []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q - %v", item, err)
+		}
+		if ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("only IPv4 CIDR supported, %q", item)
+		}
+		cidrs = append(cidrs, ipnet.String())
+	}
+	return cidrs, nil
+}
+
+// podCIDR加上用户配置的地址段
+func nonMasqCIDRs(conf GlueSubnetConf) []string {
+	cidrs := []string{}
+	if conf.PodCIDR != "" {
+		if _, ipnet, err := net.ParseCIDR(conf.PodCIDR); err == nil {
+			cidrs = append(cidrs, ipnet.String())
+		}
+	}
+	for _, c := range nonMasqueradeCIDRs {
+		if !StringInArr(cidrs, c) {
+			cidrs = append(cidrs, c)
+		}
+	}
+	return cidrs
+}
+
+func InitNatBackend(name string) error {
+	b, err := newNatBackend(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Use nat backend %s (%s)\n", b.Name(), name)
+	natBackend = b
+	return nil
+}
+
+// auto模式下重新检测，kube-proxy可能晚于glued启动
+func redetectNatBackend() {
+	if *argNatBackend != NatBackendAuto {
+		return
+	}
+	name := detectNatBackend()
+	if name == natBackend.Name() {
+		return
+	}
+	b, err := newNatBackend(name)
+	if err != nil {
+		return
+	}
+	fmt.Printf("nat backend changed from %s to %s\n", natBackend.Name(), name)
+	natBackend.Clean()
+	natBackend = b
+}
+
+func UpdateNat(conf GlueSubnetConf) error {
+	fmt.Printf("Update %s rules...\n", natBackend.Name())
+	changed, err := natBackend.Sync(conf)
+	if err != nil {
+		fmt.Printf("%s rules sync fail - %v, retry later\n", natBackend.Name(), err)
+		retryNatSync()
+		return err
+	}
+
+	if changed {
+		fmt.Printf("%s rules update success\n", natBackend.Name())
+	} else {
+		fmt.Printf("%s rules up to date\n", natBackend.Name())
+	}
+	return nil
+}
+
+func CheckNat() error {
+	if natBackend == nil {
+		return fmt.Errorf("nat backend not initialized")
+	}
+	return natBackend.Check(subnetConf)
+}
+
+func CleanNat() error {
+	if natBackend == nil {
+		return nil
+	}
+	fmt.Printf("Clean %s rules...\n", natBackend.Name())
+	return natBackend.Clean()
+}
+
+// 依赖的链还未创建时，后台重试直到同步成功
+func retryNatSync() {
+	natRetryLock.Lock()
+	defer natRetryLock.Unlock()
+	if natRetryRunning {
+		return
+	}
+	natRetryRunning = true
+
+	go func() {
+		for {
+			time.Sleep(natRetryInterval)
+
+			dataPlaneLock.Lock()
+			err := inGlueNetns(func() error {
+				redetectNatBackend()
+				_, err := natBackend.Sync(subnetConf)
+				return err
+			})
+			recordReconcile("nat", err)
+			dataPlaneLock.Unlock()
+
+			if err == nil {
+				fmt.Printf("%s rules sync success after retry\n", natBackend.Name())
+				break
+			}
+			fmt.Printf("%s rules sync retry fail - %v\n", natBackend.Name(), err)
+		}
+
+		natRetryLock.Lock()
+		natRetryRunning = false
+		natRetryLock.Unlock()
+	}()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	AnnotationNetem = "glue.io/netem"
+)
+
+var (
+	netemLock    sync.Mutex
+	netemApplied = map[string]netemState{} // pod -> 已生效的配置
+)
+
+// Spec为空表示已确认pod上没有netem
+type netemState struct {
+	ContainerID string
+	Spec        string
+}
+
+func parsePercent(s string) (float32, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 32)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percent %q", s)
+	}
+	return float32(v), nil
+}
+
+func parseUsec(s string) (uint32, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return uint32(d / time.Microsecond), nil
+}
+
+// 取出可选参数，只有带%的数值才被认为是相关性参数
+func optionalPercent(args []string, i *int) (float32, error) {
+	if *i+1 < len(args) && strings.HasSuffix(args[*i+1], "%") {
+		*i++
+		return parsePercent(args[*i])
+	}
+	return 0, nil
+}
+
+/*
+解析netem参数，语法与tc-netem一致（部分）：
+
+	delay TIME [JITTER [CORRELATION]]
+	loss PERCENT [CORRELATION]
+	duplicate PERCENT [CORRELATION]
+	reorder PERCENT [CORRELATION]
+	corrupt PERCENT [CORRELATION]
+	gap DISTANCE
+	limit PACKETS
+
+例如：delay 50ms 10ms loss 1%
+*/
+func ParseNetem(spec string) (*netlink.NetemQdiscAttrs, error) {
+	attrs := &netlink.NetemQdiscAttrs{}
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty netem spec")
+	}
+
+	var err error
+	for i := 0; i < len(args); i++ {
+		key := args[i]
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("netem option %q needs a value", key)
+		}
+		i++
+
+		switch key {
+		case "delay":
+			if attrs.Latency, err = parseUsec(args[i]); err != nil {
+				return nil, err
+			}
+			if i+1 < len(args) && !strings.HasSuffix(args[i+1], "%") {
+				if _, perr := time.ParseDuration(args[i+1]); perr == nil {
+					i++
+					attrs.Jitter, _ = parseUsec(args[i])
+				}
+			}
+			attrs.DelayCorr, err = optionalPercent(args, &i)
+		case "loss":
+			if attrs.Loss, err = parsePercent(args[i]); err != nil {
+				return nil, err
+			}
+			attrs.LossCorr, err = optionalPercent(args, &i)
+		case "duplicate":
+			if attrs.Duplicate, err = parsePercent(args[i]); err != nil {
+				return nil, err
+			}
+			attrs.DuplicateCorr, err = optionalPercent(args, &i)
+		case "reorder":
+			if attrs.ReorderProb, err = parsePercent(args[i]); err != nil {
+				return nil, err
+			}
+			attrs.ReorderCorr, err = optionalPercent(args, &i)
+		case "corrupt":
+			if attrs.CorruptProb, err = parsePercent(args[i]); err != nil {
+				return nil, err
+			}
+			attrs.CorruptCorr, err = optionalPercent(args, &i)
+		case "gap":
+			var v uint64
+			if v, err = strconv.ParseUint(args[i], 10, 32); err == nil {
+				attrs.Gap = uint32(v)
+			}
+		case "limit":
+			var v uint64
+			if v, err = strconv.ParseUint(args[i], 10, 32); err == nil {
+				attrs.Limit = uint32(v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported netem option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid netem option %q - %v", key, err)
+		}
+	}
+
+	if attrs.ReorderProb > 0 && attrs.Latency == 0 {
+		return nil, fmt.Errorf("netem reorder requires delay")
+	}
+	return attrs, nil
+}
+
+/*
+tc qdisc replace dev eth0 root netem delay 50ms loss 1%
+tc qdisc del dev eth0 root
+*/
+func setPodNetem(rec *PodRecord, attrs *netlink.NetemQdiscAttrs) error {
+	return DoInPodNetns(rec, func() error {
+		link, err := netlink.LinkByName(rec.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to get pod device %q: %v", rec.IfName, err)
+		}
+
+		qattrs := netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		}
+
+		if attrs == nil {
+			qds, err := netlink.QdiscList(link)
+			if err != nil {
+				return err
+			}
+			for _, q := range qds {
+				if q.Type() == "netem" && q.Attrs().Parent == netlink.HANDLE_ROOT {
+					fmt.Printf("Netem: remove netem from pod %s/%s\n", rec.PodNamespace, rec.PodName)
+					return netlink.QdiscDel(q)
+				}
+			}
+			return nil
+		}
+
+		return netlink.QdiscReplace(netlink.NewNetem(qattrs, *attrs))
+	})
+}
+
+func netemOnUpdate(pod *apiv1.Pod) error {
+	key := podKey(pod)
+	spec := strings.TrimSpace(pod.Annotations[AnnotationNetem])
+
+	netemLock.Lock()
+	defer netemLock.Unlock()
+
+	applied, ok := netemApplied[key]
+
+	rec, err := FindPodRecord(pod.Namespace, pod.Name)
+	if err != nil {
+		// pod网络还没有创建，等待后续事件
+		return nil
+	}
+
+	// pod sandbox重建后需要重新下发
+	if ok && applied.Spec == spec && applied.ContainerID == rec.ContainerID {
+		return nil
+	}
+
+	// annotation可能在glued停止期间或watch中断时删除，按pod上实际的qdisc清理
+	if spec == "" {
+		if err := setPodNetem(rec, nil); err != nil {
+			return err
+		}
+		netemApplied[key] = netemState{ContainerID: rec.ContainerID}
+		return nil
+	}
+
+	attrs, err := ParseNetem(spec)
+	if err != nil {
+		return fmt.Errorf("annotation %s: %v", AnnotationNetem, err)
+	}
+
+	fmt.Printf("Netem: set netem [%s] on pod %s\n", spec, key)
+	if err := setPodNetem(rec, attrs); err != nil {
+		return err
+	}
+	netemApplied[key] = netemState{ContainerID: rec.ContainerID, Spec: spec}
+	return nil
+}
+
+func netemOnDelete(pod *apiv1.Pod) error {
+	netemLock.Lock()
+	delete(netemApplied, podKey(pod))
+	netemLock.Unlock()
+	return nil
+}
+
+// 清理已不存在或没有annotation的pod上遗留的netem
+func netemOnSynced() {
+	recs, err := ListPodRecords()
+	if err != nil {
+		fmt.Printf("Netem: list pod records fail - %v\n", err)
+		return
+	}
+
+	netemLock.Lock()
+	defer netemLock.Unlock()
+	for _, rec := range recs {
+		st, ok := netemApplied[rec.PodNamespace+"/"+rec.PodName]
+		if ok && st.ContainerID == rec.ContainerID {
+			continue
+		}
+		// sandbox已删除时网络命名空间不存在，忽略错误
+		setPodNetem(rec, nil)
+	}
+}
+
+func init() {
+	RegisterPodHandler(PodHandler{
+		Name:     "Netem",
+		OnUpdate: netemOnUpdate,
+		OnDelete: netemOnDelete,
+		OnSynced: netemOnSynced,
+	})
+}
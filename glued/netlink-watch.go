@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// 合并短时间内的多个事件
+	netlinkEventDelay = time.Second
+)
+
+// master网卡的状态快照
+type masterSnapshot struct {
+	Index int
+	Name  string
+	MTU   int
+	Up    bool
+}
+
+func snapshotOf(link netlink.Link) masterSnapshot {
+	return masterSnapshot{
+		Index: link.Attrs().Index,
+		Name:  link.Attrs().Name,
+		MTU:   link.Attrs().MTU,
+		Up:    link.Attrs().Flags&net.FlagUp != 0,
+	}
+}
+
+// master网卡重建、改名或MTU变化时重建glue设备，并重新下发本节点pod的配置
+func rebuildOnMasterChange(old, cur masterSnapshot) {
+	if old.Name != cur.Name {
+		fmt.Printf("NetlinkWatch: master renamed %s -> %s\n", old.Name, cur.Name)
+		dataPlaneLock.Lock()
+		subnetConf.Master.Master = cur.Name
+		dataPlaneLock.Unlock()
+	}
+	if subnetConf.NodeCIDR == "" {
+		return
+	}
+
+	showGlueRunning(&subnetConf)
+	UpdateGlueConf()
+
+	if old.Index != cur.Index {
+		ResyncLocalPods()
+	}
+}
+
+/*
+订阅netlink的link/addr/route事件，master网卡变化时立即更新glue配置，不等待下一次node事件：
+  - master网卡重建（index变化）、改名、MTU变化：重建glue设备、tc规则和iptables规则，更新子网文件
+  - master网卡删除：上报节点网络不可用
+  - 其他相关事件（up/down、地址、路由、glue设备被删除）：执行一次调和
+
+订阅出错或中断后重新订阅
+*/
+func WatchNetlink() {
+	for {
+		if err := watchNetlinkOnce(); err != nil {
+			fmt.Printf("NetlinkWatch: %v, resubscribe\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func watchNetlinkOnce() error {
+	linkCh := make(chan netlink.LinkUpdate, 64)
+	addrCh := make(chan netlink.AddrUpdate, 64)
+	routeCh := make(chan netlink.RouteUpdate, 64)
+	done := make(chan struct{})
+	defer close(done)
+	errCh := make(chan error, 3)
+	onErr := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+
+	// netlink socket创建后即与命名空间绑定
+	if err := inGlueNetns(func() error {
+		return netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{ErrorCallback: onErr})
+	}); err != nil {
+		return fmt.Errorf("subscribe link fail - %v", err)
+	}
+	if err := inGlueNetns(func() error {
+		return netlink.AddrSubscribeWithOptions(addrCh, done, netlink.AddrSubscribeOptions{ErrorCallback: onErr})
+	}); err != nil {
+		return fmt.Errorf("subscribe addr fail - %v", err)
+	}
+	if err := inGlueNetns(func() error {
+		return netlink.RouteSubscribeWithOptions(routeCh, done, netlink.RouteSubscribeOptions{ErrorCallback: onErr})
+	}); err != nil {
+		return fmt.Errorf("subscribe route fail - %v", err)
+	}
+	fmt.Printf("NetlinkWatch: watching master %s\n", subnetConf.Master.Master)
+
+	var snap masterSnapshot
+	inGlueNetns(func() error {
+		link, err := netlink.LinkByName(subnetConf.Master.Master)
+		if err == nil {
+			snap = snapshotOf(link)
+		}
+		return err
+	})
+
+	timer := time.NewTimer(netlinkEventDelay)
+	timer.Stop()
+	pending := false
+	rebuild := false
+	old := snap
+
+	schedule := func(needRebuild bool) {
+		if !pending {
+			old = snap
+		}
+		pending = true
+		rebuild = rebuild || needRebuild
+		timer.Reset(netlinkEventDelay)
+	}
+
+	for {
+		select {
+		case u, ok := <-linkCh:
+			if !ok {
+				return fmt.Errorf("link subscription closed")
+			}
+			attrs := u.Link.Attrs()
+			switch {
+			case attrs.Name == DefaltGlueDeviceName:
+				schedule(false)
+			case u.Header.Type == unix.RTM_DELLINK && attrs.Index == snap.Index:
+				fmt.Printf("NetlinkWatch: master %s deleted\n", attrs.Name)
+				ReportNodeNetwork(fmt.Errorf("master netcard %s deleted", attrs.Name))
+			case u.Header.Type == unix.RTM_NEWLINK && (attrs.Index == snap.Index || attrs.Name == snap.Name):
+				cur := snapshotOf(u.Link)
+				if cur == snap {
+					continue
+				}
+				fmt.Printf("NetlinkWatch: master changed %+v -> %+v\n", snap, cur)
+				needRebuild := cur.Index != snap.Index || cur.Name != snap.Name || cur.MTU != snap.MTU
+				snap = cur
+				schedule(needRebuild)
+			}
+		case u, ok := <-addrCh:
+			if !ok {
+				return fmt.Errorf("addr subscription closed")
+			}
+			if u.LinkIndex == snap.Index {
+				fmt.Printf("NetlinkWatch: master address changed %v(new=%v)\n", u.LinkAddress.String(), u.NewAddr)
+				schedule(false)
+			}
+		case u, ok := <-routeCh:
+			if !ok {
+				return fmt.Errorf("route subscription closed")
+			}
+			if u.LinkIndex == snap.Index && (u.Dst == nil || u.Dst.String() == "0.0.0.0/0") {
+				fmt.Printf("NetlinkWatch: master default route changed\n")
+				schedule(false)
+			}
+		case err := <-errCh:
+			return fmt.Errorf("subscribe error - %v", err)
+		case <-timer.C:
+			pending = false
+			if rebuild {
+				rebuild = false
+				rebuildOnMasterChange(old, snap)
+			} else {
+				ReconcileDataPlane()
+			}
+		}
+	}
+}
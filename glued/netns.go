@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	namedNetnsDir = "/var/run/netns"
+	glueRunDir    = "/run/glue"
+)
+
+/*
+在指定的网络命名空间中运行数据面，用于在一台机器上测试或模拟多个节点：
+
+	ip netns add node1
+	glued -netns node1 -pod-cidr 10.10.0.0/16 -service-cidr 10.96.0.0/12 -node-cidr 10.10.1.0/24
+
+设备、路由、iptables/nftables、tc和主机参数都在该命名空间中配置，iptables等外部命令继承当前线程的命名空间。
+子网文件和pod记录目录使用默认值时按命名空间区分：/run/glue/<netns>/subnet.json，/run/glue/<netns>/pods，
+插件配置中的 nodeNetns 需要指定同一个命名空间
+*/
+var glueNetns ns.NetNS
+
+// 名称对应 /var/run/netns/<name>，包含路径分隔符时按路径处理
+func netnsPath(spec string) string {
+	if strings.Contains(spec, "/") {
+		return spec
+	}
+	return filepath.Join(namedNetnsDir, spec)
+}
+
+func OpenGlueNetns(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	netns, err := ns.GetNS(netnsPath(spec))
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", spec, err)
+	}
+	glueNetns = netns
+
+	// 使用默认路径时按命名空间区分，避免多个实例互相覆盖
+	name := filepath.Base(spec)
+	if *argSubnetFile == defaultSubnetFile {
+		*argSubnetFile = filepath.Join(glueRunDir, name, filepath.Base(defaultSubnetFile))
+	}
+	if *argPodsDir == defaultPodsDir {
+		*argPodsDir = filepath.Join(glueRunDir, name, filepath.Base(defaultPodsDir))
+	}
+	fmt.Printf("Run data plane in netns %s\n", netns.Path())
+	return nil
+}
+
+// 在glue的网络命名空间中执行，未指定命名空间时直接执行
+func inGlueNetns(f func() error) error {
+	if glueNetns == nil {
+		return f()
+	}
+	return glueNetns.Do(func(_ ns.NetNS) error {
+		return f()
+	})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+/*
+通过netlink(NETLINK_NETFILTER)直接配置nftables，不依赖nft命令，消息格式参考libnftnl：
+
+	修改：NFNL_MSG_BATCH_BEGIN、NFT_MSG_NEWTABLE/NEWCHAIN/NEWRULE...、NFNL_MSG_BATCH_END 在一个事务中提交
+	查询：NFT_MSG_GETCHAIN/GETRULE 按表dump，逐个属性与期望配置比较
+*/
+const (
+	nfAccept = 1 // NF_ACCEPT
+
+	nftRecvBufSize = 1 << 16
+)
+
+// netlink属性，nested时data为空
+type nftAttr struct {
+	typ      uint16
+	data     []byte
+	children []nftAttr
+}
+
+func nftLeaf(typ uint16, data []byte) nftAttr {
+	return nftAttr{typ: typ, data: data}
+}
+
+func nftNested(typ uint16, children ...nftAttr) nftAttr {
+	return nftAttr{typ: typ, children: children}
+}
+
+func nftString(typ uint16, s string) nftAttr {
+	return nftLeaf(typ, nl.ZeroTerminated(s))
+}
+
+func nftBe32(typ uint16, v uint32) nftAttr {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return nftLeaf(typ, buf)
+}
+
+func (a nftAttr) rtAttr() *nl.RtAttr {
+	if len(a.children) == 0 {
+		return nl.NewRtAttr(int(a.typ), a.data)
+	}
+	attr := nl.NewRtAttr(int(a.typ)|unix.NLA_F_NESTED, nil)
+	for _, c := range a.children {
+		attr.AddChild(c.rtAttr())
+	}
+	return attr
+}
+
+// 内核返回的属性与期望一致，allow中的属性由内核补充，可以额外出现
+func nftAttrsMatch(want []nftAttr, got []byte, allow map[uint16]bool) bool {
+	attrs, err := nl.ParseRouteAttr(got)
+	if err != nil {
+		return false
+	}
+
+	matched := 0
+	for _, a := range attrs {
+		typ := a.Attr.Type & nl.NLA_TYPE_MASK
+		var w *nftAttr
+		for i := range want {
+			if want[i].typ == typ {
+				w = &want[i]
+			}
+		}
+		if w == nil {
+			if allow[typ] {
+				continue
+			}
+			return false
+		}
+		if !w.match(a.Value) {
+			return false
+		}
+		matched++
+	}
+	return matched == len(want)
+}
+
+func (a nftAttr) match(got []byte) bool {
+	if len(a.children) == 0 {
+		return bytes.Equal(a.data, got)
+	}
+	return nftAttrsMatch(a.children, got, nil)
+}
+
+// 从属性列表中取出指定属性
+func nftGetAttr(data []byte, typ uint16) ([]byte, bool) {
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return nil, false
+	}
+	for _, a := range attrs {
+		if a.Attr.Type&nl.NLA_TYPE_MASK == typ {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+func nftGetString(data []byte, typ uint16) string {
+	v, _ := nftGetAttr(data, typ)
+	return string(bytes.TrimRight(v, "\x00"))
+}
+
+// struct nfgenmsg
+type nfgenmsg struct {
+	family uint8
+	resID  uint16
+}
+
+func (m *nfgenmsg) Len() int {
+	return 4
+}
+
+func (m *nfgenmsg) Serialize() []byte {
+	return []byte{m.family, unix.NFNETLINK_V0, byte(m.resID >> 8), byte(m.resID)}
+}
+
+type nftMsg struct {
+	typ   uint16 // NFT_MSG_*
+	flags uint16
+	attrs []nftAttr
+}
+
+func nftMsgName(typ uint16) string {
+	switch typ {
+	case unix.NFT_MSG_NEWTABLE:
+		return "add table"
+	case unix.NFT_MSG_DELTABLE:
+		return "delete table"
+	case unix.NFT_MSG_NEWCHAIN:
+		return "add chain"
+	case unix.NFT_MSG_NEWRULE:
+		return "add rule"
+	}
+	return fmt.Sprintf("nft msg %d", typ)
+}
+
+type nftConn struct {
+	fd  int
+	seq uint32
+}
+
+func openNftConn() (*nftConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("open netfilter netlink socket fail - %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bind netfilter netlink socket fail - %v", err)
+	}
+	tv := unix.Timeval{Sec: 10}
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	return &nftConn{fd: fd}, nil
+}
+
+func (c *nftConn) Close() {
+	unix.Close(c.fd)
+}
+
+func (c *nftConn) serialize(typ uint16, flags uint16, family uint8, attrs []nftAttr) []byte {
+	c.seq++
+	req := &nl.NetlinkRequest{
+		NlMsghdr: unix.NlMsghdr{
+			Type:  typ,
+			Flags: unix.NLM_F_REQUEST | flags,
+			Seq:   c.seq,
+		},
+	}
+	req.AddData(&nfgenmsg{family: family, resID: unix.NFNL_SUBSYS_NFTABLES})
+	for _, a := range attrs {
+		req.AddData(a.rtAttr())
+	}
+	return req.Serialize()
+}
+
+func (c *nftConn) send(buf []byte) error {
+	return unix.Sendto(c.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+}
+
+func (c *nftConn) receive() ([]syscall.NetlinkMessage, error) {
+	buf := make([]byte, nftRecvBufSize)
+	n, _, err := unix.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return syscall.ParseNetlinkMessage(buf[:n])
+}
+
+func nlmsgErrno(m syscall.NetlinkMessage) error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("short netlink error message")
+	}
+	if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+	return nil
+}
+
+// 在一个事务中提交全部修改，任一消息失败时整个事务回滚
+func (c *nftConn) commit(msgs []nftMsg) error {
+	buf := c.serialize(unix.NFNL_MSG_BATCH_BEGIN, 0, unix.AF_UNSPEC, nil)
+	pending := map[uint32]uint16{}
+	for _, m := range msgs {
+		typ := uint16(unix.NFNL_SUBSYS_NFTABLES<<8) | m.typ
+		buf = append(buf, c.serialize(typ, m.flags|unix.NLM_F_ACK, unix.NFPROTO_IPV4, m.attrs)...)
+		pending[c.seq] = m.typ
+	}
+	buf = append(buf, c.serialize(unix.NFNL_MSG_BATCH_END, 0, unix.AF_UNSPEC, nil)...)
+
+	if err := c.send(buf); err != nil {
+		return fmt.Errorf("send nftables batch fail - %v", err)
+	}
+	for len(pending) > 0 {
+		replies, err := c.receive()
+		if err != nil {
+			return fmt.Errorf("receive nftables ack fail - %v", err)
+		}
+		for _, m := range replies {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			typ, ok := pending[m.Header.Seq]
+			if !ok {
+				continue
+			}
+			delete(pending, m.Header.Seq)
+			if err := nlmsgErrno(m); err != nil {
+				return fmt.Errorf("%s fail - %v", nftMsgName(typ), err)
+			}
+		}
+	}
+	return nil
+}
+
+// 查询，返回各消息中nfgenmsg之后的属性
+func (c *nftConn) query(msgType uint16, flags uint16, attrs ...nftAttr) ([][]byte, error) {
+	typ := uint16(unix.NFNL_SUBSYS_NFTABLES<<8) | msgType
+	if err := c.send(c.serialize(typ, flags|unix.NLM_F_ACK, unix.NFPROTO_IPV4, attrs)); err != nil {
+		return nil, err
+	}
+	seq := c.seq
+
+	var res [][]byte
+	for {
+		replies, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range replies {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return res, nil
+			case unix.NLMSG_ERROR:
+				return res, nlmsgErrno(m)
+			}
+			if len(m.Data) >= 4 {
+				res = append(res, m.Data[4:])
+			}
+		}
+	}
+}
+
+// 表是否存在
+func nftTableExists(table string) bool {
+	c, err := openNftConn()
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+
+	_, err = c.query(unix.NFT_MSG_GETTABLE, 0, nftString(unix.NFTA_TABLE_NAME, table))
+	return err == nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	nftTableName = "glue"
+
+	// x/sys/unix中未定义的属性
+	nftaBitwiseOp     = 0x6
+	nftaChainFlags    = 0xa
+	nftaChainID       = 0xb
+	nftaChainUserdata = 0xc
+)
+
+/*
+nftables后端，规则全部放在独立的glue表中，通过netlink整表原子替换：
+
+	table ip glue {
+		chain prerouting {
+			type filter hook prerouting priority -150; policy accept;
+			iifname "glue" ip saddr 172.24.0.0/24 ip daddr 172.23.0.0/24 meta mark set meta mark | 0x1000
+		}
+		chain postrouting {
+			type nat hook postrouting priority 100; policy accept;
+			meta mark & 0x1000 == 0x1000 meta mark set meta mark ^ 0x1000 masquerade
+			(出口网关规则，见egress.go)
+			ip saddr != 172.24.0.0/24 return
+			ip daddr 172.24.0.0/21 return
+			ip daddr 10.0.0.0/8 return
+			...
+			masquerade
+		}
+	}
+
+prerouting在DNAT(priority -100)之前执行，匹配的是服务地址。
+检查时读取表中的链和规则，逐条比较表达式，手工修改的规则同样会被修复
+*/
+type nftablesBackend struct{}
+
+func (b *nftablesBackend) Name() string {
+	return NatBackendNftables
+}
+
+// 规则中的一个表达式，attrs为NFTA_EXPR_DATA中的属性
+type nftExpr struct {
+	name  string
+	attrs []nftAttr
+}
+
+type nftRule struct {
+	chain string
+	text  string // nft语法，用于日志和预演
+	exprs []nftExpr
+}
+
+type nftChain struct {
+	name     string
+	typ      string
+	hook     uint32
+	priority int32
+	hookName string
+}
+
+var nftChains = []nftChain{
+	{name: "prerouting", typ: "filter", hook: unix.NF_INET_PRE_ROUTING, priority: -150, hookName: "prerouting"},
+	{name: "postrouting", typ: "nat", hook: unix.NF_INET_POST_ROUTING, priority: 100, hookName: "postrouting"},
+}
+
+// 内核返回时补充的属性，比较时忽略
+var (
+	nftChainKernelAttrs = map[uint16]bool{
+		unix.NFTA_CHAIN_HANDLE:   true,
+		unix.NFTA_CHAIN_USE:      true,
+		unix.NFTA_CHAIN_COUNTERS: true,
+		nftaChainFlags:           true,
+		nftaChainID:              true,
+		nftaChainUserdata:        true,
+	}
+	nftExprKernelAttrs = map[string]map[uint16]bool{
+		"bitwise": {nftaBitwiseOp: true},
+		"nat":     {unix.NFTA_NAT_REG_ADDR_MAX: true, unix.NFTA_NAT_FLAGS: true},
+	}
+)
+
+func nftData(typ uint16, value []byte) nftAttr {
+	return nftNested(typ, nftLeaf(unix.NFTA_DATA_VALUE, value))
+}
+
+func nftU32(v uint32) []byte {
+	buf := make([]byte, 4)
+	nl.NativeEndian().PutUint32(buf, v)
+	return buf
+}
+
+// 加载ip头中的地址到寄存器1
+func nftPayloadIP(off uint32) nftExpr {
+	return nftExpr{name: "payload", attrs: []nftAttr{
+		nftBe32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+		nftBe32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_NETWORK_HEADER),
+		nftBe32(unix.NFTA_PAYLOAD_OFFSET, off),
+		nftBe32(unix.NFTA_PAYLOAD_LEN, 4),
+	}}
+}
+
+func nftMetaLoad(key uint32) nftExpr {
+	return nftExpr{name: "meta", attrs: []nftAttr{
+		nftBe32(unix.NFTA_META_DREG, unix.NFT_REG_1),
+		nftBe32(unix.NFTA_META_KEY, key),
+	}}
+}
+
+func nftMetaSet(key uint32) nftExpr {
+	return nftExpr{name: "meta", attrs: []nftAttr{
+		nftBe32(unix.NFTA_META_KEY, key),
+		nftBe32(unix.NFTA_META_SREG, unix.NFT_REG_1),
+	}}
+}
+
+// 寄存器1 = (寄存器1 & mask) ^ xor
+func nftBitwise(mask, xor []byte) nftExpr {
+	return nftExpr{name: "bitwise", attrs: []nftAttr{
+		nftBe32(unix.NFTA_BITWISE_SREG, unix.NFT_REG_1),
+		nftBe32(unix.NFTA_BITWISE_DREG, unix.NFT_REG_1),
+		nftBe32(unix.NFTA_BITWISE_LEN, uint32(len(mask))),
+		nftData(unix.NFTA_BITWISE_MASK, mask),
+		nftData(unix.NFTA_BITWISE_XOR, xor),
+	}}
+}
+
+func nftCmp(op uint32, data []byte) nftExpr {
+	return nftExpr{name: "cmp", attrs: []nftAttr{
+		nftBe32(unix.NFTA_CMP_SREG, unix.NFT_REG_1),
+		nftBe32(unix.NFTA_CMP_OP, op),
+		nftData(unix.NFTA_CMP_DATA, data),
+	}}
+}
+
+func nftVerdict(code int32) nftExpr {
+	return nftExpr{name: "immediate", attrs: []nftAttr{
+		nftBe32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT),
+		nftNested(unix.NFTA_IMMEDIATE_DATA,
+			nftNested(unix.NFTA_DATA_VERDICT, nftBe32(unix.NFTA_VERDICT_CODE, uint32(code)))),
+	}}
+}
+
+func nftImmediate(data []byte) nftExpr {
+	return nftExpr{name: "immediate", attrs: []nftAttr{
+		nftBe32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_1),
+		nftData(unix.NFTA_IMMEDIATE_DATA, data),
+	}}
+}
+
+func nftMasq() nftExpr {
+	return nftExpr{name: "masq"}
+}
+
+// SNAT为寄存器1中的地址
+func nftSnat() nftExpr {
+	return nftExpr{name: "nat", attrs: []nftAttr{
+		nftBe32(unix.NFTA_NAT_TYPE, unix.NFT_NAT_SNAT),
+		nftBe32(unix.NFTA_NAT_FAMILY, unix.NFPROTO_IPV4),
+		nftBe32(unix.NFTA_NAT_REG_ADDR_MIN, unix.NFT_REG_1),
+	}}
+}
+
+// ip saddr/daddr 匹配地址段，off为tcU32OffSrcIP或tcU32OffDstIP
+func nftMatchCIDR(off uint32, cidr string, op uint32) ([]nftExpr, string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ipnet.IP.To4() == nil {
+		return nil, "", fmt.Errorf("invalid IPv4 CIDR %q", cidr)
+	}
+	exprs := []nftExpr{nftPayloadIP(off)}
+	if ones, _ := ipnet.Mask.Size(); ones < 32 {
+		exprs = append(exprs, nftBitwise([]byte(net.IP(ipnet.Mask).To4()), make([]byte, 4)))
+	}
+	exprs = append(exprs, nftCmp(op, []byte(ipnet.IP.To4())))
+
+	field := "ip saddr "
+	if off == tcU32OffDstIP {
+		field = "ip daddr "
+	}
+	if op == unix.NFT_CMP_NEQ {
+		field += "!= "
+	}
+	return exprs, field + ipnet.String(), nil
+}
+
+// 规则构造，出错时记录第一个错误
+type nftRuleBuilder struct {
+	rules []nftRule
+	err   error
+}
+
+func (rb *nftRuleBuilder) add(chain string, text []string, exprs ...[]nftExpr) {
+	r := nftRule{chain: chain, text: strings.Join(text, " ")}
+	for _, e := range exprs {
+		r.exprs = append(r.exprs, e...)
+	}
+	rb.rules = append(rb.rules, r)
+}
+
+func (rb *nftRuleBuilder) cidr(off uint32, cidr string, op uint32) ([]nftExpr, string) {
+	exprs, text, err := nftMatchCIDR(off, cidr, op)
+	if err != nil && rb.err == nil {
+		rb.err = err
+	}
+	return exprs, text
+}
+
+func nftRules(conf GlueSubnetConf) ([]nftRule, error) {
+	rb := &nftRuleBuilder{}
+	mark := nftU32(glueMasqMark)
+
+	// pod经glue设备访问服务的流量打标记
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, DefaltGlueDeviceName)
+	src, srcText := rb.cidr(tcU32OffSrcIP, conf.NodeCIDR, unix.NFT_CMP_EQ)
+	dst, dstText := rb.cidr(tcU32OffDstIP, conf.ServiceCIDR, unix.NFT_CMP_EQ)
+	rb.add("prerouting",
+		[]string{fmt.Sprintf("iifname \"%s\"", DefaltGlueDeviceName), srcText, dstText,
+			fmt.Sprintf("meta mark set meta mark | 0x%x", glueMasqMark)},
+		[]nftExpr{nftMetaLoad(unix.NFT_META_IIFNAME), nftCmp(unix.NFT_CMP_EQ, ifname)},
+		src, dst,
+		[]nftExpr{nftMetaLoad(unix.NFT_META_MARK), nftBitwise(nftU32(^uint32(glueMasqMark)), mark), nftMetaSet(unix.NFT_META_MARK)})
+
+	rb.add("postrouting",
+		[]string{fmt.Sprintf("meta mark & 0x%x == 0x%x meta mark set meta mark ^ 0x%x masquerade", glueMasqMark, glueMasqMark, glueMasqMark)},
+		[]nftExpr{nftMetaLoad(unix.NFT_META_MARK), nftBitwise(mark, make([]byte, 4)), nftCmp(unix.NFT_CMP_EQ, mark),
+			nftMetaLoad(unix.NFT_META_MARK), nftBitwise(nftU32(0xffffffff), mark), nftMetaSet(unix.NFT_META_MARK),
+			nftMasq()})
+
+	// 集群内地址不做SNAT
+	nonMasq := func() {
+		for _, c := range nonMasqCIDRs(conf) {
+			exprs, text := rb.cidr(tcU32OffDstIP, c, unix.NFT_CMP_EQ)
+			rb.add("postrouting", []string{text, "return"}, exprs, []nftExpr{nftVerdict(unix.NFT_RETURN)})
+		}
+	}
+
+	// 出口网关规则
+	if rules := getEgressNatRules(); len(rules) > 0 {
+		nonMasq()
+		for _, r := range rules {
+			exprs, text := rb.cidr(tcU32OffSrcIP, r.Src, unix.NFT_CMP_EQ)
+			if r.SNAT == "" {
+				rb.add("postrouting", []string{text, "accept"}, exprs, []nftExpr{nftVerdict(nfAccept)})
+				continue
+			}
+			snat := net.ParseIP(r.SNAT).To4()
+			if snat == nil {
+				return nil, fmt.Errorf("invalid egress ip %q", r.SNAT)
+			}
+			rb.add("postrouting", []string{text, "snat to", snat.String()}, exprs, []nftExpr{nftImmediate([]byte(snat)), nftSnat()})
+		}
+	}
+	if *argMasqEgress {
+		exprs, text := rb.cidr(tcU32OffSrcIP, conf.NodeCIDR, unix.NFT_CMP_NEQ)
+		rb.add("postrouting", []string{text, "return"}, exprs, []nftExpr{nftVerdict(unix.NFT_RETURN)})
+		nonMasq()
+		rb.add("postrouting", []string{"masquerade"}, []nftExpr{nftMasq()})
+	}
+	return rb.rules, rb.err
+}
+
+func (ch nftChain) attrs() []nftAttr {
+	return []nftAttr{
+		nftString(unix.NFTA_CHAIN_TABLE, nftTableName),
+		nftString(unix.NFTA_CHAIN_NAME, ch.name),
+		nftNested(unix.NFTA_CHAIN_HOOK,
+			nftBe32(unix.NFTA_HOOK_HOOKNUM, ch.hook),
+			nftBe32(unix.NFTA_HOOK_PRIORITY, uint32(ch.priority))),
+		nftBe32(unix.NFTA_CHAIN_POLICY, nfAccept),
+		nftString(unix.NFTA_CHAIN_TYPE, ch.typ),
+	}
+}
+
+func (r nftRule) exprsAttr() nftAttr {
+	var elems []nftAttr
+	for _, e := range r.exprs {
+		elem := []nftAttr{nftString(unix.NFTA_EXPR_NAME, e.name)}
+		if len(e.attrs) > 0 {
+			elem = append(elem, nftNested(unix.NFTA_EXPR_DATA, e.attrs...))
+		}
+		elems = append(elems, nftNested(unix.NFTA_LIST_ELEM, elem...))
+	}
+	return nftNested(unix.NFTA_RULE_EXPRESSIONS, elems...)
+}
+
+// 内核中规则的表达式与期望一致
+func (r nftRule) match(got []byte) bool {
+	elems, err := nl.ParseRouteAttr(got)
+	if err != nil || len(elems) != len(r.exprs) {
+		return false
+	}
+	for i, elem := range elems {
+		e := r.exprs[i]
+		if elem.Attr.Type&nl.NLA_TYPE_MASK != unix.NFTA_LIST_ELEM || nftGetString(elem.Value, unix.NFTA_EXPR_NAME) != e.name {
+			return false
+		}
+		data, _ := nftGetAttr(elem.Value, unix.NFTA_EXPR_DATA)
+		if !nftAttrsMatch(e.attrs, data, nftExprKernelAttrs[e.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 期望配置的nft语法，用于预演
+func nftText(rules []nftRule) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "table ip %s {\n", nftTableName)
+	for _, ch := range nftChains {
+		fmt.Fprintf(buf, "\tchain %s {\n", ch.name)
+		fmt.Fprintf(buf, "\t\ttype %s hook %s priority %d; policy accept;\n", ch.typ, ch.hookName, ch.priority)
+		for _, r := range rules {
+			if r.chain == ch.name {
+				fmt.Fprintf(buf, "\t\t%s\n", r.text)
+			}
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (b *nftablesBackend) Check(conf GlueSubnetConf) error {
+	rules, err := nftRules(conf)
+	if err != nil {
+		return err
+	}
+	c, err := openNftConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := c.query(unix.NFT_MSG_GETTABLE, 0, nftString(unix.NFTA_TABLE_NAME, nftTableName)); err != nil {
+		return fmt.Errorf("table ip %s not found", nftTableName)
+	}
+
+	chains, err := c.query(unix.NFT_MSG_GETCHAIN, unix.NLM_F_DUMP, nftString(unix.NFTA_CHAIN_TABLE, nftTableName))
+	if err != nil {
+		return fmt.Errorf("list chains in table ip %s fail - %v", nftTableName, err)
+	}
+	found := map[string]bool{}
+	for _, data := range chains {
+		if nftGetString(data, unix.NFTA_CHAIN_TABLE) != nftTableName {
+			continue
+		}
+		name := nftGetString(data, unix.NFTA_CHAIN_NAME)
+		var want *nftChain
+		for i := range nftChains {
+			if nftChains[i].name == name {
+				want = &nftChains[i]
+			}
+		}
+		if want == nil {
+			return fmt.Errorf("unexpected chain %s in table ip %s", name, nftTableName)
+		}
+		if !nftAttrsMatch(want.attrs(), data, nftChainKernelAttrs) {
+			return fmt.Errorf("chain %s in table ip %s changed", name, nftTableName)
+		}
+		found[name] = true
+	}
+	for _, ch := range nftChains {
+		if !found[ch.name] {
+			return fmt.Errorf("chain %s in table ip %s not found", ch.name, nftTableName)
+		}
+	}
+
+	msgs, err := c.query(unix.NFT_MSG_GETRULE, unix.NLM_F_DUMP, nftString(unix.NFTA_RULE_TABLE, nftTableName))
+	if err != nil {
+		return fmt.Errorf("list rules in table ip %s fail - %v", nftTableName, err)
+	}
+	current := map[string][][]byte{}
+	for _, data := range msgs {
+		if nftGetString(data, unix.NFTA_RULE_TABLE) != nftTableName {
+			continue
+		}
+		chain := nftGetString(data, unix.NFTA_RULE_CHAIN)
+		exprs, _ := nftGetAttr(data, unix.NFTA_RULE_EXPRESSIONS)
+		current[chain] = append(current[chain], exprs)
+	}
+	for _, ch := range nftChains {
+		var want []nftRule
+		for _, r := range rules {
+			if r.chain == ch.name {
+				want = append(want, r)
+			}
+		}
+		got := current[ch.name]
+		if len(got) != len(want) {
+			return fmt.Errorf("chain %s in table ip %s has %d rules, want %d", ch.name, nftTableName, len(got), len(want))
+		}
+		for i := range want {
+			if !want[i].match(got[i]) {
+				return fmt.Errorf("rule %d in chain %s changed, want: %s", i+1, ch.name, want[i].text)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *nftablesBackend) Sync(conf GlueSubnetConf) (bool, error) {
+	if err := b.Check(conf); err == nil {
+		return false, nil
+	} else {
+		fmt.Printf("nftables: %v\n", err)
+	}
+
+	rules, err := nftRules(conf)
+	if err != nil {
+		return false, err
+	}
+	c, err := openNftConn()
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	// 先确保表存在再删除，整表在一个事务中完成替换
+	table := []nftAttr{nftString(unix.NFTA_TABLE_NAME, nftTableName)}
+	msgs := []nftMsg{
+		{typ: unix.NFT_MSG_NEWTABLE, flags: unix.NLM_F_CREATE, attrs: table},
+		{typ: unix.NFT_MSG_DELTABLE, attrs: table},
+		{typ: unix.NFT_MSG_NEWTABLE, flags: unix.NLM_F_CREATE, attrs: table},
+	}
+	for _, ch := range nftChains {
+		msgs = append(msgs, nftMsg{typ: unix.NFT_MSG_NEWCHAIN, flags: unix.NLM_F_CREATE, attrs: ch.attrs()})
+	}
+	for _, r := range rules {
+		msgs = append(msgs, nftMsg{typ: unix.NFT_MSG_NEWRULE, flags: unix.NLM_F_CREATE | unix.NLM_F_APPEND, attrs: []nftAttr{
+			nftString(unix.NFTA_RULE_TABLE, nftTableName),
+			nftString(unix.NFTA_RULE_CHAIN, r.chain),
+			r.exprsAttr(),
+		}})
+	}
+	if err := c.commit(msgs); err != nil {
+		return false, fmt.Errorf("replace table ip %s fail - %v", nftTableName, err)
+	}
+	return true, nil
+}
+
+func (b *nftablesBackend) Plan(conf GlueSubnetConf) ([]planItem, error) {
+	err := b.Check(conf)
+	if err == nil {
+		return nil, nil
+	}
+
+	rules, rerr := nftRules(conf)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return []planItem{{
+		Component: "nftables",
+		Action:    planChange,
+		Object:    "table ip " + nftTableName,
+		Current:   err.Error(),
+		Desired:   nftText(rules),
+	}}, nil
+}
+
+func (b *nftablesBackend) Clean() error {
+	if !nftTableExists(nftTableName) {
+		return nil
+	}
+	c, err := openNftConn()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.commit([]nftMsg{{typ: unix.NFT_MSG_DELTABLE, attrs: []nftAttr{nftString(unix.NFTA_TABLE_NAME, nftTableName)}}})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	TaintNetworkUnavailable = "glue.io/network-unavailable"
+
+	reasonGlueReady  = "GlueIsUp"
+	reasonGlueFailed = "GlueSetupFailed"
+)
+
+var (
+	kubeClient *kubernetes.Clientset // 使用用户指定的CIDR时为空
+
+	nodeStatusLock     sync.Mutex
+	nodeStatusReported bool
+	nodeStatusLastErr  string
+)
+
+/*
+网络插件负责维护节点的 NetworkUnavailable 状态：
+
+	glue数据面就绪后设置为False，配置失败时设置为True并附带错误信息
+	LastTransitionTime只在状态变化时更新，仅错误信息变化时沿用原值
+*/
+func patchNetworkUnavailable(unavailable bool, reason, message string) error {
+	status := apiv1.ConditionFalse
+	if unavailable {
+		status = apiv1.ConditionTrue
+	}
+
+	now := metav1.NewTime(time.Now())
+	transition := now
+	if node, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), getNodeName(), metav1.GetOptions{}); err == nil {
+		for _, c := range node.Status.Conditions {
+			if c.Type == apiv1.NodeNetworkUnavailable && c.Status == status && !c.LastTransitionTime.IsZero() {
+				transition = c.LastTransitionTime
+			}
+		}
+	}
+
+	condition := apiv1.NodeCondition{
+		Type:               apiv1.NodeNetworkUnavailable,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: transition,
+		LastHeartbeatTime:  now,
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []apiv1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = kubeClient.CoreV1().Nodes().PatchStatus(context.TODO(), getNodeName(), patch)
+	return err
+}
+
+// 添加或删除节点上的glue污点
+func updateNetworkTaint(add bool) error {
+	node, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), getNodeName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var taints []apiv1.Taint
+	found := false
+	for _, t := range node.Spec.Taints {
+		if t.Key == TaintNetworkUnavailable {
+			found = true
+			continue
+		}
+		taints = append(taints, t)
+	}
+	if found == add {
+		return nil
+	}
+
+	if add {
+		taints = append(taints, apiv1.Taint{
+			Key:    TaintNetworkUnavailable,
+			Effect: apiv1.TaintEffectNoSchedule,
+		})
+	}
+	node.Spec.Taints = taints
+
+	fmt.Printf("NodeStatus: set taint %s = %v\n", TaintNetworkUnavailable, add)
+	_, err = kubeClient.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{})
+	return err
+}
+
+// 根据glue配置结果上报节点网络状态，状态不变时不重复上报
+func ReportNodeNetwork(glueErr error) {
+	// kubelet根据CNI配置文件判断节点网络是否就绪
+	SyncCNIConf(glueErr)
+
+	if kubeClient == nil {
+		return
+	}
+
+	errMsg := ""
+	if glueErr != nil {
+		errMsg = glueErr.Error()
+	}
+
+	nodeStatusLock.Lock()
+	defer nodeStatusLock.Unlock()
+
+	if nodeStatusReported && nodeStatusLastErr == errMsg {
+		return
+	}
+
+	var err error
+	if glueErr == nil {
+		fmt.Printf("NodeStatus: glue network ready\n")
+		err = patchNetworkUnavailable(false, reasonGlueReady, "glue network is ready")
+	} else {
+		fmt.Printf("NodeStatus: glue network unavailable - %v\n", glueErr)
+		err = patchNetworkUnavailable(true, reasonGlueFailed, errMsg)
+	}
+	if err != nil {
+		fmt.Printf("NodeStatus: patch node condition fail - %v\n", err)
+		return
+	}
+
+	if *argNetworkTaint {
+		if err := updateNetworkTaint(glueErr != nil); err != nil {
+			fmt.Printf("NodeStatus: update node taint fail - %v\n", err)
+			return
+		}
+	}
+
+	nodeStatusReported = true
+	nodeStatusLastErr = errMsg
+}
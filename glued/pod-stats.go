@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	tcPrioCounter = 20000
+)
+
+/*
+pod流量统计：
+macvlan/ipvlan的pod流量不经过主机的netfilter和veth，在master网卡的clsact上按pod地址计数，
+action为continue，不影响后续的镜像和重定向规则
+
+	tc filter add dev enp0s8 ingress prio 20000 proto ip u32 match ip dst 172.24.0.5/32 action gact continue
+	tc filter add dev enp0s8 egress prio 20000 proto ip u32 match ip src 172.24.0.5/32 action gact continue
+
+同节点pod之间（macvlan bridge模式）的流量不经过master网卡，不在统计范围内
+*/
+type podCounterState struct {
+	Namespace   string
+	Name        string
+	ContainerID string
+	IPs         []string
+}
+
+var (
+	podCounterLock sync.Mutex
+	podCounters    = map[string]podCounterState{}
+)
+
+func creatTCCountActions() []netlink.Action {
+	gact := &netlink.GenericAction{
+		ActionAttrs: netlink.ActionAttrs{
+			Action: netlink.TC_ACT_UNSPEC,
+		},
+	}
+	return []netlink.Action{gact}
+}
+
+func counterFilters(masterIndex int, ipstr string) (ingress *netlink.U32, egress *netlink.U32) {
+	ipnet := &net.IPNet{IP: net.ParseIP(ipstr), Mask: net.CIDRMask(32, 32)}
+
+	ingress = createTCU32FilterAt(masterIndex, ipnet, tcU32OffDstIP, tcPrioCounter)
+	ingress.Parent = clsactIngressParent
+
+	egress = createTCU32FilterAt(masterIndex, ipnet, tcU32OffSrcIP, tcPrioCounter)
+	egress.Parent = clsactEgressParent
+	return ingress, egress
+}
+
+func addPodCounter(st podCounterState) error {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return err
+	}
+	if err := addClsact(master); err != nil {
+		return err
+	}
+
+	for _, ip := range st.IPs {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		ingress, egress := counterFilters(master.Attrs().Index, ip)
+		for _, f := range []*netlink.U32{ingress, egress} {
+			delTCFilterLike(master, f)
+			f.Actions = creatTCCountActions()
+			if err := netlink.FilterAdd(f); err != nil {
+				return fmt.Errorf("add counter filter for %s error, %w", ip, err)
+			}
+		}
+	}
+	return nil
+}
+
+func delPodCounter(st podCounterState) {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return
+	}
+
+	for _, ip := range st.IPs {
+		if net.ParseIP(ip).To4() == nil {
+			continue
+		}
+		ingress, egress := counterFilters(master.Attrs().Index, ip)
+		delTCFilterLike(master, ingress)
+		delTCFilterLike(master, egress)
+	}
+}
+
+func podCounterOnUpdate(pod *apiv1.Pod) error {
+	if pod.Spec.HostNetwork {
+		return nil
+	}
+
+	key := podKey(pod)
+	rec, err := FindPodRecord(pod.Namespace, pod.Name)
+	if err != nil {
+		return nil
+	}
+
+	podCounterLock.Lock()
+	defer podCounterLock.Unlock()
+
+	applied, ok := podCounters[key]
+	if ok && applied.ContainerID == rec.ContainerID {
+		return nil
+	}
+	if ok {
+		delPodCounter(applied)
+		delete(podCounters, key)
+	}
+
+	st := podCounterState{
+		Namespace:   pod.Namespace,
+		Name:        pod.Name,
+		ContainerID: rec.ContainerID,
+		IPs:         rec.IPs,
+	}
+	if len(st.IPs) == 0 && pod.Status.PodIP != "" {
+		st.IPs = []string{pod.Status.PodIP}
+	}
+	if len(st.IPs) == 0 {
+		return nil
+	}
+
+	if err := addPodCounter(st); err != nil {
+		delPodCounter(st)
+		return err
+	}
+	podCounters[key] = st
+	return nil
+}
+
+func podCounterOnDelete(pod *apiv1.Pod) error {
+	key := podKey(pod)
+
+	podCounterLock.Lock()
+	defer podCounterLock.Unlock()
+
+	if st, ok := podCounters[key]; ok {
+		delPodCounter(st)
+		delete(podCounters, key)
+	}
+	return nil
+}
+
+func CleanPodCounters() {
+	podCounterLock.Lock()
+	defer podCounterLock.Unlock()
+
+	for key, st := range podCounters {
+		delPodCounter(st)
+		delete(podCounters, key)
+	}
+}
+
+type podTraffic struct {
+	RxBytes, RxPackets uint64
+	TxBytes, TxPackets uint64
+}
+
+// 读取master网卡上的计数filter，按pod汇总
+func collectPodTraffic() map[string]*podTraffic {
+	res := map[string]*podTraffic{}
+
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return res
+	}
+
+	podCounterLock.Lock()
+	ipToPod := map[uint32]string{}
+	for key, st := range podCounters {
+		for _, ip := range st.IPs {
+			if v4 := net.ParseIP(ip).To4(); v4 != nil {
+				ipToPod[binary.BigEndian.Uint32(v4)] = key
+			}
+		}
+		res[key] = &podTraffic{}
+	}
+	podCounterLock.Unlock()
+
+	for _, parent := range []uint32{clsactIngressParent, clsactEgressParent} {
+		stats, err := ListTCU32FilterStats(master, parent)
+		if err != nil {
+			fmt.Printf("PodCounter: %v\n", err)
+			continue
+		}
+		for _, st := range stats {
+			if st.Priority != tcPrioCounter {
+				continue
+			}
+			key, ok := ipToPod[st.Val]
+			if !ok {
+				continue
+			}
+			// master入方向为pod接收，出方向为pod发送
+			if parent == clsactIngressParent && st.Off == tcU32OffDstIP {
+				res[key].RxBytes += st.Bytes
+				res[key].RxPackets += st.Packets
+			}
+			if parent == clsactEgressParent && st.Off == tcU32OffSrcIP {
+				res[key].TxBytes += st.Bytes
+				res[key].TxPackets += st.Packets
+			}
+		}
+	}
+	return res
+}
+
+func podTrafficMetric(get func(t *podTraffic) uint64) func() []MetricSample {
+	return func() []MetricSample {
+		podCounterLock.Lock()
+		labels := map[string]map[string]string{}
+		for key, st := range podCounters {
+			labels[key] = map[string]string{"namespace": st.Namespace, "pod": st.Name}
+		}
+		podCounterLock.Unlock()
+
+		var samples []MetricSample
+		for key, t := range collectPodTraffic() {
+			if l, ok := labels[key]; ok {
+				samples = append(samples, MetricSample{Labels: l, Value: float64(get(t))})
+			}
+		}
+		return samples
+	}
+}
+
+// 清理不属于当前pod记录的计数filter，glued停止期间删除的pod遗留的规则在此删除
+func podCounterOnSynced() {
+	master, err := netlink.LinkByName(subnetConf.Master.Master)
+	if err != nil {
+		return
+	}
+	recs, err := ListPodRecords()
+	if err != nil {
+		fmt.Printf("PodCounter: list pod records fail - %v\n", err)
+		return
+	}
+
+	podIPs := map[uint32]bool{}
+	for _, rec := range recs {
+		for _, ip := range rec.IPs {
+			if v4 := net.ParseIP(ip).To4(); v4 != nil {
+				podIPs[binary.BigEndian.Uint32(v4)] = true
+			}
+		}
+	}
+
+	podCounterLock.Lock()
+	defer podCounterLock.Unlock()
+	sweepTCFilters(master, tcPrioCounter, func(f *netlink.U32) bool {
+		return f.Sel.Keys[0].Mask == 0xffffffff && podIPs[f.Sel.Keys[0].Val]
+	})
+}
+
+func podCounterOnReset() {
+	podCounterLock.Lock()
+	podCounters = map[string]podCounterState{}
+	podCounterLock.Unlock()
+}
+
+func init() {
+	RegisterPodHandler(PodHandler{
+		Name:     "PodCounter",
+		OnUpdate: podCounterOnUpdate,
+		OnDelete: podCounterOnDelete,
+		OnReset:  podCounterOnReset,
+		OnSynced: podCounterOnSynced,
+	})
+
+	RegisterMetric("glue_pod_receive_bytes_total", "Bytes received by the pod, counted on the master ingress.", "counter",
+		podTrafficMetric(func(t *podTraffic) uint64 { return t.RxBytes }))
+	RegisterMetric("glue_pod_receive_packets_total", "Packets received by the pod, counted on the master ingress.", "counter",
+		podTrafficMetric(func(t *podTraffic) uint64 { return t.RxPackets }))
+	RegisterMetric("glue_pod_transmit_bytes_total", "Bytes sent by the pod, counted on the master egress.", "counter",
+		podTrafficMetric(func(t *podTraffic) uint64 { return t.TxBytes }))
+	RegisterMetric("glue_pod_transmit_packets_total", "Packets sent by the pod, counted on the master egress.", "counter",
+		podTrafficMetric(func(t *podTraffic) uint64 { return t.TxPackets }))
+}
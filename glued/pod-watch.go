@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	defaultPodsDir = "/run/glue/pods"
+)
+
+// 节点上pod的记录，由glue插件在ADD时写入
+type PodRecord struct {
+	ContainerID  string   `json:"containerID"`
+	PodName      string   `json:"podName"`
+	PodNamespace string   `json:"podNamespace"`
+	Netns        string   `json:"netns"`
+	IfName       string   `json:"ifName"`
+	IPs          []string `json:"ips"`
+	Gateway      string   `json:"gateway,omitempty"`
+}
+
+// 本节点pod变化时的处理函数
+type PodHandler struct {
+	Name     string
+	OnUpdate func(pod *apiv1.Pod) error
+	OnDelete func(pod *apiv1.Pod) error
+	OnReset  func() // master重建后内核中的配置已丢失，清空已下发的记录
+	OnSynced func() // 本节点全部pod处理完成后调用，清理已不存在的pod遗留的配置
+}
+
+var podHandlers []PodHandler
+
+func RegisterPodHandler(h PodHandler) {
+	podHandlers = append(podHandlers, h)
+}
+
+func podKey(pod *apiv1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
+}
+
+func getNodeName() string {
+	hn, _ := os.Hostname()
+	return hn
+}
+
+// 读取全部pod记录
+func ListPodRecords() ([]*PodRecord, error) {
+	files, err := ioutil.ReadDir(*argPodsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var recs []*PodRecord
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(*argPodsDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		rec := &PodRecord{}
+		if err := json.Unmarshal(buf, rec); err != nil {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// 根据pod名称查找glue插件写入的记录，同一pod有多条记录时取最新的
+func FindPodRecord(namespace, name string) (*PodRecord, error) {
+	files, err := ioutil.ReadDir(*argPodsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *PodRecord
+	var foundTime time.Time
+	for _, f := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(*argPodsDir, f.Name()))
+		if err != nil {
+			continue
+		}
+		rec := &PodRecord{}
+		if err := json.Unmarshal(buf, rec); err != nil {
+			continue
+		}
+		if rec.PodNamespace != namespace || rec.PodName != name {
+			continue
+		}
+		if found == nil || f.ModTime().After(foundTime) {
+			found = rec
+			foundTime = f.ModTime()
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no record found for pod %s/%s", namespace, name)
+	}
+	return found, nil
+}
+
+// 进入pod的网络命名空间执行
+func DoInPodNetns(rec *PodRecord, f func() error) error {
+	netns, err := ns.GetNS(rec.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", rec.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return f()
+	})
+}
+
+func dispatchPodEvent(event watch.Event) {
+	pod, ok := event.Object.(*apiv1.Pod)
+	if !ok {
+		return
+	}
+
+	for _, h := range podHandlers {
+		h := h
+		err := inGlueNetns(func() error {
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if h.OnUpdate != nil {
+					return h.OnUpdate(pod)
+				}
+			case watch.Deleted:
+				if h.OnDelete != nil {
+					return h.OnDelete(pod)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("%s: handle pod %s fail - %v\n", h.Name, podKey(pod), err)
+		}
+	}
+}
+
+// 清空各模块的记录并重新处理本节点的全部pod
+func ResyncLocalPods() {
+	if kubeClient == nil {
+		return
+	}
+
+	for _, h := range podHandlers {
+		if h.OnReset != nil {
+			h.OnReset()
+		}
+	}
+
+	pods, err := kubeClient.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + getNodeName(),
+	})
+	if err != nil {
+		fmt.Printf("Error: list pods fail - %v\n", err)
+		return
+	}
+
+	fmt.Printf("resync %d local pods\n", len(pods.Items))
+	for i := range pods.Items {
+		dispatchPodEvent(watch.Event{Type: watch.Modified, Object: &pods.Items[i]})
+	}
+	for _, h := range podHandlers {
+		if h.OnSynced != nil {
+			inGlueNetns(func() error {
+				h.OnSynced()
+				return nil
+			})
+		}
+	}
+}
+
+// watch本节点上的pod，watch中断后重新建立
+func WatchLocalPods(clientset *kubernetes.Clientset) {
+	opts := metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + getNodeName(),
+	}
+
+	// 启动时先处理一遍全部pod，glued停止期间删除的pod遗留的配置在此清理
+	ResyncLocalPods()
+
+	for {
+		podWatcher, err := clientset.CoreV1().Pods("").Watch(context.TODO(), opts)
+		if err != nil {
+			fmt.Printf("Error: watch pods fail - %v\n", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for event := range podWatcher.ResultChan() {
+			dispatchPodEvent(event)
+		}
+
+		fmt.Printf("pod watch closed, rewatch...\n")
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultGlueRouteTable = 300
+	glueRulePriority      = 1000
+)
+
+/*
+podCIDR的流量固定经glue设备收发，避免与master网卡的地址段重叠时回包从master发出，
+被rp_filter或上联交换机丢弃：
+
+	ip rule add to 172.24.0.0/21 lookup 300 prio 1000
+	ip rule add from 172.24.0.0/21 lookup 300 prio 1000
+	ip route add 172.24.0.0/21 dev glue src 172.24.0.1 scope link table 300
+
+路由表中只有podCIDR的路由，其他目的地址查找失败后继续匹配后续规则
+*/
+func desiredGlueRoutes(conf GlueSubnetConf) ([]netlink.Rule, []netlink.Route, error) {
+	_, podNet, err := net.ParseCIDR(conf.PodCIDR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse podCIDR %q fail - %v", conf.PodCIDR, err)
+	}
+	addr, err := getGlueAddr(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	glue, err := netlink.LinkByName(DefaltGlueDeviceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	to := netlink.NewRule()
+	to.Priority = glueRulePriority
+	to.Table = *argRouteTable
+	to.Dst = podNet
+
+	from := netlink.NewRule()
+	from.Priority = glueRulePriority
+	from.Table = *argRouteTable
+	from.Src = podNet
+
+	route := netlink.Route{
+		LinkIndex: glue.Attrs().Index,
+		Dst:       podNet,
+		Src:       addr.IP,
+		Scope:     netlink.SCOPE_LINK,
+		Type:      unix.RTN_UNICAST,
+		Table:     *argRouteTable,
+	}
+	return []netlink.Rule{*to, *from}, []netlink.Route{route}, nil
+}
+
+func glueRuleKey(r netlink.Rule) string {
+	return fmt.Sprintf("%d/%v/%v/%d", r.Priority, r.Src, r.Dst, r.Table)
+}
+
+func glueRouteKey(r netlink.Route) string {
+	return fmt.Sprintf("%d/%v/%v/%d", r.LinkIndex, r.Dst, r.Src, r.Scope)
+}
+
+// 声明式同步glue的策略路由，返回修改的项
+func SyncGlueRoutes(conf GlueSubnetConf) ([]string, error) {
+	rules, routes, err := desiredGlueRoutes(conf)
+	if err != nil {
+		return nil, err
+	}
+	return applyGlueRoutes(rules, routes, false)
+}
+
+// dryRun为true时只计算修改项，不修改内核配置
+func applyGlueRoutes(rules []netlink.Rule, routes []netlink.Route, dryRun bool) ([]string, error) {
+	var changes []string
+
+	// 只处理指向glue路由表的规则，同优先级上其他程序的规则不处理
+	filter := &netlink.Rule{Priority: glueRulePriority, Table: *argRouteTable}
+	curRules, err := netlink.RuleListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_PRIORITY|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("list rules fail - %v", err)
+	}
+	desiredRules := map[string]bool{}
+	for _, r := range rules {
+		desiredRules[glueRuleKey(r)] = true
+	}
+	for i := range curRules {
+		key := glueRuleKey(curRules[i])
+		if desiredRules[key] {
+			delete(desiredRules, key)
+			continue
+		}
+		changes = append(changes, "del rule "+glueRuleKey(curRules[i]))
+		if !dryRun {
+			netlink.RuleDel(&curRules[i])
+		}
+	}
+
+	curRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: *argRouteTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return changes, fmt.Errorf("list routes fail - %v", err)
+	}
+	desiredRoutes := map[string]bool{}
+	for _, r := range routes {
+		desiredRoutes[glueRouteKey(r)] = true
+	}
+	for i := range curRoutes {
+		key := glueRouteKey(curRoutes[i])
+		if desiredRoutes[key] {
+			delete(desiredRoutes, key)
+			continue
+		}
+		changes = append(changes, "del route "+curRoutes[i].String())
+		if !dryRun {
+			netlink.RouteDel(&curRoutes[i])
+		}
+	}
+
+	// 先添加路由再添加规则
+	for i := range routes {
+		if !desiredRoutes[glueRouteKey(routes[i])] {
+			continue
+		}
+		changes = append(changes, "add route "+routes[i].String())
+		if dryRun {
+			continue
+		}
+		if err := netlink.RouteReplace(&routes[i]); err != nil {
+			return changes, fmt.Errorf("add route %v fail - %v", routes[i], err)
+		}
+	}
+	for i := range rules {
+		if !desiredRules[glueRuleKey(rules[i])] {
+			continue
+		}
+		changes = append(changes, "add rule "+glueRuleKey(rules[i]))
+		if dryRun {
+			continue
+		}
+		if err := netlink.RuleAdd(&rules[i]); err != nil {
+			return changes, fmt.Errorf("add rule %v fail - %v", glueRuleKey(rules[i]), err)
+		}
+	}
+	return changes, nil
+}
+
+func UpdateGlueRoutes(conf GlueSubnetConf) error {
+	changes, err := SyncGlueRoutes(conf)
+	for _, c := range changes {
+		fmt.Printf("PolicyRoute: %s\n", c)
+	}
+	return err
+}
+
+func CleanGlueRoutes() error {
+	fmt.Printf("Clean glue policy routes...\n")
+	_, err := applyGlueRoutes(nil, nil, false)
+	return err
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultCNIBinDir = "/opt/cni/bin"
+	// 生成的CNI配置使用的版本，委托插件需要支持
+	defaultCNIVersion = "1.0.0"
+
+	preflightProbePrefix = "gluepf-"
+)
+
+/*
+启动前检查内核和插件对各数据面的支持，避免到创建设备时才发现缺少模块：
+
+	glued preflight -stick-cni-master enp0s8
+
+内核功能：在临时网络命名空间中基于veth试建macvlan、ipvlan、clsact qdisc、u32 filter和mirred action。
+master网卡：试建临时的macvlan/ipvlan子接口，检查是否接受多个MAC地址（无线网卡不转发其他MAC的报文）。
+委托插件：检查CNI目录中的macvlan、ipvlan、host-local、portmap是否存在并支持部署使用的CNI版本。
+stick-cni-type=auto 时沿用子网文件中的类型，首次安装时优先使用macvlan，不可用时使用ipvlan（依赖tc的clsact、u32和mirred）
+*/
+type preflightCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type preflightReport struct {
+	Master   string           `json:"master"`
+	Checks   []preflightCheck `json:"checks"`
+	Datapath string           `json:"datapath,omitempty"`
+}
+
+var (
+	preflightLock       sync.Mutex
+	lastPreflightReport *preflightReport
+)
+
+func (r *preflightReport) add(name string, err error) {
+	c := preflightCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+func (r *preflightReport) ok(names ...string) bool {
+	for _, name := range names {
+		found := false
+		for _, c := range r.Checks {
+			if c.Name == name {
+				found = true
+				if !c.OK {
+					return false
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// 各数据面依赖的检查项
+func datapathRequirements(typ string) []string {
+	switch typ {
+	case "macvlan":
+		return []string{"kernel/macvlan", "master/macvlan", "plugin/macvlan", "plugin/host-local"}
+	case "ipvlan":
+		return []string{"kernel/ipvlan", "kernel/clsact", "kernel/u32", "kernel/mirred", "master/ipvlan", "plugin/ipvlan", "plugin/host-local"}
+	}
+	return nil
+}
+
+// 选择可用的数据面，macvlan优先
+func (r *preflightReport) selectDatapath() (string, error) {
+	for _, typ := range []string{"macvlan", "ipvlan"} {
+		if r.ok(datapathRequirements(typ)...) {
+			return typ, nil
+		}
+	}
+	return "", fmt.Errorf("neither macvlan nor ipvlan datapath is usable on %s, check the preflight report", r.Master)
+}
+
+// 在临时网络命名空间中探测内核功能，线程切换命名空间后不解锁，goroutine退出时线程随之退出
+func probeKernelFeatures(r *preflightReport) {
+	res := map[string]error{}
+	names := []string{"kernel/macvlan", "kernel/ipvlan", "kernel/clsact", "kernel/u32", "kernel/mirred"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runtime.LockOSThread()
+
+		fail := func(err error) {
+			for _, name := range names {
+				if _, ok := res[name]; !ok {
+					res[name] = err
+				}
+			}
+		}
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			fail(fmt.Errorf("create scratch netns fail - %v", err))
+			return
+		}
+
+		// 使用veth对作为父设备和重定向目标
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "pf0"}, PeerName: "pf1"}); err != nil {
+			fail(fmt.Errorf("create veth fail - %v", err))
+			return
+		}
+		peers := []netlink.Link{}
+		for _, name := range []string{"pf0", "pf1"} {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				fail(err)
+				return
+			}
+			netlink.LinkSetUp(link)
+			peers = append(peers, link)
+		}
+		parent := peers[0].Attrs().Index
+
+		res["kernel/macvlan"] = probeLinkAdd(&netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "pf-mv", ParentIndex: parent},
+			Mode:      netlink.MACVLAN_MODE_BRIDGE,
+		})
+		res["kernel/ipvlan"] = probeLinkAdd(&netlink.IPVlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "pf-iv", ParentIndex: parent},
+			Mode:      netlink.IPVLAN_MODE_L2,
+		})
+
+		if err := addClsact(peers[0]); err != nil {
+			fail(err)
+			return
+		}
+		res["kernel/clsact"] = nil
+
+		ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)}
+		f := createTCU32FilterAt(parent, ipnet, tcU32OffDstIP, tcPrioCounter)
+		f.Parent = clsactIngressParent
+		f.Actions = creatTCCountActions()
+		if err := netlink.FilterAdd(f); err != nil {
+			fail(fmt.Errorf("add u32 filter fail - %v", err))
+			return
+		}
+		res["kernel/u32"] = nil
+
+		f = createTCU32Filter(parent, ipnet)
+		f.Parent = clsactIngressParent
+		f.Actions = creatTCRedirectActions(peers[1].Attrs().Index)
+		if err := netlink.FilterAdd(f); err != nil {
+			res["kernel/mirred"] = fmt.Errorf("add mirred action fail - %v", err)
+		} else {
+			res["kernel/mirred"] = nil
+		}
+	}()
+	<-done
+
+	for _, name := range names {
+		r.add(name, res[name])
+	}
+}
+
+func probeLinkAdd(link netlink.Link) error {
+	if err := netlink.LinkAdd(link); err != nil {
+		return fmt.Errorf("create %s fail - %v", link.Type(), err)
+	}
+	return nil
+}
+
+// 在master上试建临时子接口，已有同类型的glue设备时直接认为可用
+func probeMaster(r *preflightReport, master string, dryRun bool) {
+	parent, err := netlink.LinkByName(master)
+	if err != nil {
+		for _, typ := range []string{"macvlan", "ipvlan"} {
+			r.add("master/"+typ, fmt.Errorf("master %s not found - %v", master, err))
+		}
+		return
+	}
+
+	var wirelessErr error
+	if _, err := os.Stat(filepath.Join("/sys/class/net", master, "wireless")); err == nil {
+		wirelessErr = fmt.Errorf("%s is a wireless netcard, frames from extra MAC addresses are dropped", master)
+	}
+
+	glue, _ := netlink.LinkByName(DefaltGlueDeviceName)
+	for _, typ := range []string{"macvlan", "ipvlan"} {
+		if typ == "macvlan" && wirelessErr != nil {
+			r.add("master/"+typ, wirelessErr)
+			continue
+		}
+		if glue != nil && glue.Type() == typ && glue.Attrs().ParentIndex == parent.Attrs().Index {
+			r.add("master/"+typ, nil)
+			continue
+		}
+		if dryRun {
+			r.Checks = append(r.Checks, preflightCheck{Name: "master/" + typ, OK: true, Detail: "not probed in dry run"})
+			continue
+		}
+
+		name := preflightProbePrefix + typ[:2]
+		attrs := netlink.LinkAttrs{Name: name, ParentIndex: parent.Attrs().Index}
+		var link netlink.Link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+		if typ == "ipvlan" {
+			link = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+		}
+		err := netlink.LinkAdd(link)
+		if err == nil {
+			if l, e := netlink.LinkByName(name); e == nil {
+				netlink.LinkDel(l)
+			}
+		} else {
+			err = fmt.Errorf("create %s on %s fail - %v", typ, master, err)
+		}
+		r.add("master/"+typ, err)
+	}
+}
+
+// 委托插件存在且支持部署使用的CNI版本
+func probePlugins(r *preflightReport, binDir string) {
+	for _, name := range []string{"macvlan", "ipvlan", "host-local", "portmap"} {
+		path := filepath.Join(binDir, name)
+		st, err := os.Stat(path)
+		if err != nil {
+			r.add("plugin/"+name, fmt.Errorf("%s not found", path))
+			continue
+		}
+		if st.Mode()&0111 == 0 {
+			r.add("plugin/"+name, fmt.Errorf("%s is not executable", path))
+			continue
+		}
+
+		info, err := invoke.GetVersionInfo(context.TODO(), path, nil)
+		if err != nil {
+			r.add("plugin/"+name, fmt.Errorf("get version of %s fail - %v", path, err))
+			continue
+		}
+		if !StringInArr(info.SupportedVersions(), *argCNIVersion) {
+			r.add("plugin/"+name, fmt.Errorf("%s does not support cniVersion %s, supported %v", path, *argCNIVersion, info.SupportedVersions()))
+			continue
+		}
+		r.add("plugin/"+name, nil)
+	}
+}
+
+func RunPreflight(master string) *preflightReport {
+	r := &preflightReport{Master: master}
+	probeKernelFeatures(r)
+	inGlueNetns(func() error {
+		probeMaster(r, master, *argDryRun)
+		return nil
+	})
+	probePlugins(r, *argCNIBinDir)
+
+	preflightLock.Lock()
+	lastPreflightReport = r
+	preflightLock.Unlock()
+	return r
+}
+
+func printPreflightReport(r *preflightReport) {
+	fmt.Printf("Preflight (master %s):\n", r.Master)
+	for _, c := range r.Checks {
+		status := "ok"
+		if !c.OK {
+			status = "FAIL"
+		}
+		if c.Detail != "" {
+			fmt.Printf("    %-18s %-4s %s\n", c.Name, status, c.Detail)
+		} else {
+			fmt.Printf("    %-18s %s\n", c.Name, status)
+		}
+	}
+	if r.Datapath != "" {
+		fmt.Printf("    datapath: %s\n", r.Datapath)
+	}
+}
+
+// 数据面类型确定后检查其依赖，不阻止启动
+func warnPreflight(r *preflightReport, typ string) {
+	var failed []string
+	for _, name := range datapathRequirements(typ) {
+		if !r.ok(name) {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Printf("WARNING: %s datapath may not work, failed checks: %s\n", typ, strings.Join(failed, ", "))
+	}
+}
+
+// glued preflight [flags]，输出检查结果，没有可用的数据面时返回错误
+func Preflight(args []string) error {
+	defineFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if err := OpenGlueNetns(*argNetns); err != nil {
+		return err
+	}
+
+	var master string
+	err := inGlueNetns(func() error {
+		var err error
+		master, err = SelectMaster(*argStickCniMaster)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("select master netcard fail - %v", err)
+	}
+
+	r := RunPreflight(master)
+	r.Datapath, err = r.selectDatapath()
+	printPreflightReport(r)
+	return err
+}
+
+func preflightHandler(w http.ResponseWriter, r *http.Request) {
+	preflightLock.Lock()
+	report := lastPreflightReport
+	preflightLock.Unlock()
+
+	if report == nil {
+		http.Error(w, "preflight not run", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	buf, _ := json.MarshalIndent(report, "", "  ")
+	w.Write(buf)
+}
+
+func init() {
+	RegisterAPI("/preflight", preflightHandler)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReconcileInterval = 30 * time.Second
+)
+
+var (
+	// 数据面配置的互斥锁，node事件和周期调和不能同时修改内核配置
+	dataPlaneLock sync.Mutex
+
+	metricReconcileCorrections = NewCounterVec("glue_reconcile_corrections_total", "Drift corrected by the reconcile loop, by component.", "component")
+)
+
+func logCorrection(component, format string, args ...interface{}) {
+	fmt.Printf("Reconcile: [%s] %s\n", component, fmt.Sprintf(format, args...))
+	metricReconcileCorrections.Inc(component)
+}
+
+func reconcileDevice(conf GlueSubnetConf) error {
+	return syncGlueLink(conf, func(format string, args ...interface{}) {
+		logCorrection("device", format, args...)
+	})
+}
+
+func reconcileRoute(conf GlueSubnetConf) error {
+	changes, err := SyncGlueRoutes(conf)
+	for _, c := range changes {
+		logCorrection("route", "%s", c)
+	}
+	return err
+}
+
+func reconcileNat(conf GlueSubnetConf) error {
+	changed, err := natBackend.Sync(conf)
+	if changed {
+		logCorrection("nat", "glue %s rules drifted, resynced", natBackend.Name())
+	}
+	return err
+}
+
+func reconcileTc(conf GlueSubnetConf) error {
+	if conf.Master.Type != "ipvlan" {
+		return nil
+	}
+
+	exists, err := IpvlanTcConfigExists(conf)
+	if err == nil && exists {
+		return nil
+	}
+	logCorrection("tc", "ipvlan service redirect filter missing or stale on %s, replace", conf.Master.Master)
+	return UpdateIpvlanTcConfig(conf)
+}
+
+func reconcileSysctl(conf GlueSubnetConf) error {
+	return ApplyHostSettings(conf, func(format string, args ...interface{}) {
+		logCorrection("sysctl", format, args...)
+	})
+}
+
+/*
+对比期望配置与内核中的实际配置，修复被外部修改的部分：
+
+	glue设备及其地址、策略路由、地址转换规则(iptables/nftables)、ipvlan服务重定向规则、主机参数
+*/
+func ReconcileDataPlane() error {
+	dataPlaneLock.Lock()
+	conf := subnetConf
+	if conf.NodeCIDR == "" {
+		dataPlaneLock.Unlock()
+		return nil
+	}
+	err := reconcileSteps(conf)
+	dataPlaneLock.Unlock()
+
+	// 上报需要访问apiserver，不持有数据面锁，apiserver慢时不阻塞netlink事件和出口网关同步
+	ReportNodeNetwork(err)
+	return err
+}
+
+func reconcileSteps(conf GlueSubnetConf) error {
+	var errs []string
+	steps := []struct {
+		component string
+		fn        func() error
+	}{
+		{"device", func() error { return reconcileDevice(conf) }},
+		{"route", func() error { return reconcileRoute(conf) }},
+		{"sysctl", func() error { return reconcileSysctl(conf) }},
+		{"nat", func() error { return reconcileNat(conf) }},
+		{"tc", func() error { return reconcileTc(conf) }},
+	}
+	for _, step := range steps {
+		if err := recordReconcile(step.component, inGlueNetns(step.fn)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", step.component, err))
+		}
+	}
+
+	var err error
+	if len(errs) > 0 {
+		err = fmt.Errorf("reconcile fail - %s", strings.Join(errs, "; "))
+		fmt.Printf("Reconcile: %v\n", err)
+	}
+	return err
+}
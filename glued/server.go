@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	defaultAPIAddr = "127.0.0.1:9750"
+)
+
+// glued对外提供的http接口，各功能模块在init中注册，处理函数在glue的网络命名空间中执行
+var apiMux = http.NewServeMux()
+
+func RegisterAPI(pattern string, handler http.HandlerFunc) {
+	apiMux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		inGlueNetns(func() error {
+			handler(w, r)
+			return nil
+		})
+	})
+}
+
+// 单独监听指标接口，供Prometheus从节点地址抓取，不暴露其他API
+func StartMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		inGlueNetns(func() error {
+			metricsHandler(w, r)
+			return nil
+		})
+	})
+	go func() {
+		fmt.Printf("Metrics server listen on %s\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("ERROR: metrics server exit - %v\n", err)
+		}
+	}()
+}
+
+func StartAPIServer(addr string) {
+	if addr == "" {
+		fmt.Printf("API server disabled\n")
+		return
+	}
+
+	go func() {
+		fmt.Printf("API server listen on %s\n", addr)
+		if err := http.ListenAndServe(addr, apiMux); err != nil {
+			fmt.Printf("ERROR: API server exit - %v\n", err)
+		}
+	}()
+}
@@ -37,14 +37,27 @@ func addClsact(link netlink.Link) error {
 	return nil
 }
 
+const (
+	tcU32OffSrcIP = 12 // ip头中源地址偏移
+	tcU32OffDstIP = 16 // ip头中目的地址偏移
+
+	tcPrioMirror   = 30000
+	tcPrioRedirect = 40000
+)
+
 func createTCU32Filter(masterIndex int, ipnet *net.IPNet) *netlink.U32 {
+	return createTCU32FilterAt(masterIndex, ipnet, tcU32OffDstIP, tcPrioRedirect)
+}
+
+// 按指定偏移匹配ip地址，off为tcU32OffSrcIP或tcU32OffDstIP
+func createTCU32FilterAt(masterIndex int, ipnet *net.IPNet, off int32, prio uint16) *netlink.U32 {
 	ip := ipnet.IP.Mask(ipnet.Mask).To4()
 	mask := net.IP(ipnet.Mask).To4()
 
 	return &netlink.U32{
 		FilterAttrs: netlink.FilterAttrs{
 			LinkIndex: masterIndex,
-			Priority:  40000,
+			Priority:  prio,
 			Protocol:  unix.ETH_P_IP,
 		},
 		Sel: &netlink.TcU32Sel{
@@ -54,7 +67,7 @@ func createTCU32Filter(masterIndex int, ipnet *net.IPNet) *netlink.U32 {
 				{
 					Mask: binary.BigEndian.Uint32(mask),
 					Val:  binary.BigEndian.Uint32(ip),
-					Off:  16,
+					Off:  off,
 				},
 			},
 		},
@@ -68,6 +81,15 @@ func creatTCRedirectActions(dstIndex int) []netlink.Action {
 	return []netlink.Action{mirredAct}
 }
 
+// 镜像报文后继续匹配后续filter，不影响原有的重定向规则
+func creatTCMirrorActions(dstIndex int) []netlink.Action {
+	mirredAct := netlink.NewMirredAction(dstIndex)
+	mirredAct.MirredAction = netlink.TCA_EGRESS_MIRROR
+	mirredAct.Action = netlink.TC_ACT_UNSPEC
+
+	return []netlink.Action{mirredAct}
+}
+
 func filterMatch(u32f *netlink.U32, filter netlink.Filter) bool {
 	tou32f, ok := filter.(*netlink.U32)
 	if !ok {
@@ -92,6 +114,41 @@ func filterMatch(u32f *netlink.U32, filter netlink.Filter) bool {
 	return true
 }
 
+// 比较mirred动作的类型和目标设备，glue设备重建后ifindex变化，旧filter需要替换
+func mirredActionsEqual(want, got []netlink.Action) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		w, ok1 := want[i].(*netlink.MirredAction)
+		g, ok2 := got[i].(*netlink.MirredAction)
+		if !ok1 || !ok2 || w.MirredAction != g.MirredAction || w.Ifindex != g.Ifindex {
+			return false
+		}
+	}
+	return true
+}
+
+// 与filterMatch相同，但同时比较优先级且不输出日志，用于周期性检查；u32f带有动作时同时比较动作
+func u32FilterEqual(u32f *netlink.U32, filter netlink.Filter) bool {
+	tou32f, ok := filter.(*netlink.U32)
+	if !ok || tou32f.Sel == nil || u32f.Sel == nil {
+		return false
+	}
+	if u32f.Attrs().LinkIndex != tou32f.Attrs().LinkIndex ||
+		u32f.Attrs().Protocol != tou32f.Attrs().Protocol ||
+		u32f.Attrs().Priority != tou32f.Attrs().Priority ||
+		len(u32f.Sel.Keys) != len(tou32f.Sel.Keys) || len(u32f.Sel.Keys) == 0 {
+		return false
+	}
+	if u32f.Sel.Keys[0].Mask != tou32f.Sel.Keys[0].Mask ||
+		u32f.Sel.Keys[0].Off != tou32f.Sel.Keys[0].Off ||
+		u32f.Sel.Keys[0].Val != tou32f.Sel.Keys[0].Val {
+		return false
+	}
+	return len(u32f.Actions) == 0 || mirredActionsEqual(u32f.Actions, tou32f.Actions)
+}
+
 /*
 tc qdisc add dev enp0s8 clsact
 tc filter add dev enp0s8 egress proto ip u32 match ip dst 172.23.0.0/24 action tunnel_key unset pipe action mirred ingress redirect dev glue
@@ -138,6 +195,39 @@ func UpdateIpvlanTcConfig(conf GlueSubnetConf) error {
 	return nil
 }
 
+// 检查master网卡上是否存在ipvlan服务重定向规则
+func IpvlanTcConfigExists(conf GlueSubnetConf) (bool, error) {
+	link, err := netlink.LinkByName(conf.Master.Master)
+	if err != nil {
+		return false, err
+	}
+
+	_, svcnet, err := net.ParseCIDR(conf.ServiceCIDR)
+	if err != nil {
+		return false, err
+	}
+	u32Filter := createTCU32Filter(link.Attrs().Index, svcnet)
+
+	// 重定向目标须为当前的glue设备，不一致时由UpdateIpvlanTcConfig替换
+	linkto, err := netlink.LinkByName(DefaltGlueDeviceName)
+	if err != nil {
+		return false, err
+	}
+	u32Filter.Actions = creatTCRedirectActions(linkto.Attrs().Index)
+
+	parent := uint32(netlink.HANDLE_CLSACT&0xffff0000 | netlink.HANDLE_MIN_EGRESS&0x0000ffff)
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return false, err
+	}
+	for _, filter := range filters {
+		if u32FilterEqual(u32Filter, filter) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func CleanTcConfig() {
 	//tc filter show dev enp0s8 parent ffff:fff3
 	link, _ := netlink.LinkByName(subnetConf.Master.Master)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// u32 filter的匹配条件及其action的统计
+type tcU32FilterStats struct {
+	Priority uint16
+	Off      int32
+	Val      uint32
+	Bytes    uint64
+	Packets  uint64
+}
+
+func nlaType(attr syscall.NetlinkRouteAttr) uint16 {
+	return attr.Attr.Type & nl.NLA_TYPE_MASK
+}
+
+// 解析 TCA_U32_ACT 中各action的 TCA_ACT_STATS/TCA_STATS_BASIC
+func parseTCActionStats(b []byte) (bytes uint64, packets uint64) {
+	tables, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return 0, 0
+	}
+
+	for _, table := range tables {
+		aattrs, err := nl.ParseRouteAttr(table.Value)
+		if err != nil {
+			continue
+		}
+		for _, aattr := range aattrs {
+			if nlaType(aattr) != nl.TCA_ACT_STATS {
+				continue
+			}
+			sattrs, err := nl.ParseRouteAttr(aattr.Value)
+			if err != nil {
+				continue
+			}
+			for _, sattr := range sattrs {
+				// struct gnet_stats_basic { __u64 bytes; __u32 packets; }
+				if nlaType(sattr) == nl.TCA_STATS_BASIC && len(sattr.Value) >= 12 {
+					bytes += nl.NativeEndian().Uint64(sattr.Value[0:8])
+					packets += uint64(nl.NativeEndian().Uint32(sattr.Value[8:12]))
+				}
+			}
+		}
+	}
+	return bytes, packets
+}
+
+/*
+netlink库不解析action的统计信息，这里直接dump filter：
+
+	tc -s filter show dev enp0s8 ingress
+*/
+func ListTCU32FilterStats(link netlink.Link, parent uint32) ([]tcU32FilterStats, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETTFILTER, unix.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Parent:  parent,
+	})
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWTFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("dump filter for %s error, %w", link.Attrs().Name, err)
+	}
+
+	var res []tcU32FilterStats
+	for _, m := range msgs {
+		msg := nl.DeserializeTcMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			continue
+		}
+
+		prio, _ := netlink.MajorMinor(msg.Info)
+		kind := ""
+		var options []byte
+		for _, attr := range attrs {
+			switch nlaType(attr) {
+			case nl.TCA_KIND:
+				kind = string(attr.Value[:len(attr.Value)-1])
+			case nl.TCA_OPTIONS:
+				options = attr.Value
+			}
+		}
+		if kind != "u32" || options == nil {
+			continue
+		}
+
+		oattrs, err := nl.ParseRouteAttr(options)
+		if err != nil {
+			continue
+		}
+		st := tcU32FilterStats{Priority: prio}
+		hasSel, hasAct := false, false
+		for _, oattr := range oattrs {
+			switch nlaType(oattr) {
+			case nl.TCA_U32_SEL:
+				sel := nl.DeserializeTcU32Sel(oattr.Value)
+				if sel.Nkeys > 0 {
+					// key在内核中按网络字节序保存
+					st.Off = sel.Keys[0].Off
+					st.Val = binary.BigEndian.Uint32(nativeToBytes(sel.Keys[0].Val))
+					hasSel = true
+				}
+			case nl.TCA_U32_ACT:
+				st.Bytes, st.Packets = parseTCActionStats(oattr.Value)
+				hasAct = true
+			}
+		}
+		if hasSel && hasAct {
+			res = append(res, st)
+		}
+	}
+	return res, nil
+}
+
+func nativeToBytes(v uint32) []byte {
+	b := make([]byte, 4)
+	nl.NativeEndian().PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 读取上一个实例写入的子网文件
+func loadSubnetConf(path string) (*GlueSubnetConf, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &GlueSubnetConf{}
+	if err := json.Unmarshal(buf, conf); err != nil {
+		return nil, fmt.Errorf("parse %s fail - %v", path, err)
+	}
+	return conf, nil
+}
+
+/*
+glued重启时不清理数据面，启动后各模块按声明同步，已存在且一致的配置直接沿用：
+glue设备原地更新，iptables/nftables规则、策略路由按差异修改，pod相关的tc规则重新下发
+*/
+func adoptExistingState() {
+	old, err := loadSubnetConf(*argSubnetFile)
+	if err != nil {
+		return
+	}
+
+	devErr := inGlueNetns(func() error {
+		_, err := netlink.LinkByName(DefaltGlueDeviceName)
+		return err
+	})
+	if old.Version != "" && old.Version != glueVersion {
+		fmt.Printf("Adopt: glued upgraded from %s to %s\n", old.Version, glueVersion)
+	}
+	fmt.Printf("Adopt existing glue state: subnet file %s (nodeCIDR %s, master %s), glue device exists %v\n",
+		*argSubnetFile, old.NodeCIDR, old.Master.Master, devErr == nil)
+	if old.Master.Master != subnetConf.Master.Master || old.Master.Type != subnetConf.Master.Type {
+		fmt.Printf("Adopt: master changed from %s(%s) to %s(%s), glue device will be recreated\n",
+			old.Master.Master, old.Master.Type, subnetConf.Master.Master, subnetConf.Master.Type)
+	}
+
+	// 原master上的重定向、镜像、计数规则不再使用
+	if old.Master.Master != "" && old.Master.Master != subnetConf.Master.Master {
+		inGlueNetns(func() error {
+			if master, err := netlink.LinkByName(old.Master.Master); err == nil {
+				fmt.Printf("Adopt: clean glue tc filters on old master %s\n", old.Master.Master)
+				CleanGlueTcFilters(master)
+			}
+			return nil
+		})
+	}
+}
+
+// 是否为glue添加的filter：单个匹配源/目的地址的u32选择器，动作与优先级对应
+//   - 重定向：mirred ingress redirect到glue设备，glue设备已删除时目标设备不存在
+//   - 镜像：mirred egress mirror到glued创建的镜像设备，或目标设备已不存在
+//   - 计数：gact continue
+func isGlueTcFilter(filter netlink.Filter, glueIndex int) bool {
+	u32f, ok := filter.(*netlink.U32)
+	if !ok || u32f.Protocol != unix.ETH_P_IP || u32f.Sel == nil || len(u32f.Sel.Keys) != 1 || len(u32f.Actions) != 1 {
+		return false
+	}
+	if off := u32f.Sel.Keys[0].Off; off != tcU32OffSrcIP && off != tcU32OffDstIP {
+		return false
+	}
+
+	switch u32f.Priority {
+	case tcPrioRedirect:
+		act, ok := u32f.Actions[0].(*netlink.MirredAction)
+		if !ok || act.MirredAction != netlink.TCA_INGRESS_REDIR {
+			return false
+		}
+		if act.Ifindex == glueIndex {
+			return true
+		}
+		_, err := netlink.LinkByIndex(act.Ifindex)
+		return err != nil
+	case tcPrioMirror:
+		act, ok := u32f.Actions[0].(*netlink.MirredAction)
+		if !ok || act.MirredAction != netlink.TCA_EGRESS_MIRROR {
+			return false
+		}
+		target, err := netlink.LinkByIndex(act.Ifindex)
+		return err != nil || isMirrorDevice(target.Attrs().Name)
+	case tcPrioCounter:
+		act, ok := u32f.Actions[0].(*netlink.GenericAction)
+		return ok && act.Action == netlink.TC_ACT_UNSPEC
+	}
+	return false
+}
+
+// 逐个删除glue在master网卡clsact上添加的filter，同优先级的其他filter保留，clsact上没有其他filter时一并删除
+func CleanGlueTcFilters(master netlink.Link) {
+	glueIndex := 0
+	if glue, err := netlink.LinkByName(DefaltGlueDeviceName); err == nil {
+		glueIndex = glue.Attrs().Index
+	}
+
+	for _, parent := range []uint32{clsactIngressParent, clsactEgressParent} {
+		filters, err := netlink.FilterList(master, parent)
+		if err != nil {
+			continue
+		}
+		for _, filter := range filters {
+			if isGlueTcFilter(filter, glueIndex) {
+				if err := netlink.FilterDel(filter); err != nil {
+					fmt.Printf("Uninstall: delete tc filter %v - %v\n", filter, err)
+				}
+			}
+		}
+	}
+
+	for _, parent := range []uint32{clsactIngressParent, clsactEgressParent} {
+		if filters, err := netlink.FilterList(master, parent); err != nil || len(filters) > 0 {
+			return
+		}
+	}
+	qds, err := netlink.QdiscList(master)
+	if err != nil {
+		return
+	}
+	for _, q := range qds {
+		if q.Type() == "clsact" {
+			fmt.Printf("delete clsact qdisc on %s\n", master.Attrs().Name)
+			netlink.QdiscDel(q)
+		}
+	}
+}
+
+// 删除glue创建的镜像设备
+func cleanMirrorDevices() {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return
+	}
+	for _, link := range links {
+		if isMirrorDevice(link.Attrs().Name) {
+			fmt.Printf("Uninstall: delete mirror device %s\n", link.Attrs().Name)
+			netlink.LinkDel(link)
+		}
+	}
+}
+
+// 删除启动时拷贝的CNI插件及配置文件
+func removeCopiedFiles() {
+	files := bootFiles()
+	if len(files) == 0 {
+		return
+	}
+
+	// 节点上还有pod时保留插件，否则kubelet删除pod时无法调用插件
+	recs, _ := ListPodRecords()
+
+	fmt.Printf("Delete file on delete...\n")
+	for _, f := range files {
+		if st, err := os.Stat(f[1]); err == nil && st.Mode()&0111 != 0 && len(recs) > 0 {
+			fmt.Printf("keep plugin %v, %d pods still running\n", f[1], len(recs))
+			continue
+		}
+		fmt.Printf("delete file %v\n", f[1])
+		if err := os.Remove(f[1]); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+}
+
+/*
+完全卸载glue在本节点的配置，配置从子网文件中读取：
+
+	kubectl -n kube-system exec <glue pod> -- /bin/glued uninstall
+
+删除glue设备、策略路由、出口网关配置、iptables/nftables规则、tc规则、镜像设备，
+恢复主机参数，删除子网文件及拷贝的CNI文件
+*/
+func Uninstall(args []string) error {
+	defineFlags()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if err := OpenGlueNetns(*argNetns); err != nil {
+		return err
+	}
+
+	conf, err := loadSubnetConf(*argSubnetFile)
+	if err != nil {
+		fmt.Printf("Uninstall: no subnet file - %v, clean what can be found\n", err)
+		conf = &GlueSubnetConf{}
+	}
+	subnetConf = *conf
+
+	// 先删除CNI配置，kubelet不再向本节点调度新的pod网络
+	if *argCNIConfFile != "" {
+		fmt.Printf("delete cni conf %v\n", *argCNIConfFile)
+		os.Remove(*argCNIConfFile)
+	}
+
+	fmt.Printf("Uninstall glue, clean resources...\n")
+	inGlueNetns(func() error {
+		// tc规则按目标设备识别，先于glue设备和镜像设备删除
+		if master, err := netlink.LinkByName(subnetConf.Master.Master); err == nil {
+			CleanGlueTcFilters(master)
+		}
+		CleanGlueRoutes()
+		CleanEgress()
+		CleanDevices()
+		for _, b := range []NatBackend{&iptablesBackend{}, &nftablesBackend{}} {
+			if err := b.Clean(); err != nil {
+				fmt.Printf("Uninstall: clean %s rules - %v\n", b.Name(), err)
+			}
+		}
+		cleanMirrorDevices()
+		RestoreHostSettings()
+		return nil
+	})
+
+	// 清理待删除的文件
+	fmt.Printf("delete subnet file %v\n", *argSubnetFile)
+	os.Remove(*argSubnetFile)
+	removeCopiedFiles()
+
+	fmt.Printf("Uninstall glue done\n")
+	return nil
+}